@@ -4,15 +4,24 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/serversfordev/deploy/internal/bluegreen"
 	"github.com/serversfordev/deploy/internal/config"
 	"github.com/serversfordev/deploy/internal/deployer"
+	"github.com/serversfordev/deploy/internal/lock"
 	"github.com/serversfordev/deploy/internal/logger"
+	"github.com/serversfordev/deploy/internal/maintenance"
 	"github.com/serversfordev/deploy/internal/provider"
+	"github.com/serversfordev/deploy/internal/provider/git"
+	"github.com/serversfordev/deploy/internal/signature"
+	"github.com/serversfordev/deploy/internal/supervisor"
 	"github.com/serversfordev/deploy/internal/utils"
 )
 
@@ -22,6 +31,16 @@ var (
 	date    = "unknown"
 )
 
+// fileFlag returns the flag for the path to the configuration file, a new
+// one for every command, as flags hold the values they are set to.
+func fileFlag() *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:    "file",
+		Aliases: []string{"f"},
+		Usage:   "path to config.toml configuration file",
+	}
+}
+
 var app = &cli.App{
 	Name:    "deploy",
 	Usage:   "a simple application deployment tool",
@@ -45,16 +64,123 @@ var app = &cli.App{
 			Usage:  "start deployment process",
 			Action: startCommand,
 			Flags: []cli.Flag{
-				&cli.StringFlag{
-					Name:    "file",
-					Aliases: []string{"f"},
-					Usage:   "path to app.yaml configuration file",
-				},
+				fileFlag(),
 				&cli.BoolFlag{
 					Name:  "force",
 					Usage: "force deployment even if no changes detected",
 					Value: false,
 				},
+				&cli.StringFlag{
+					Name:  "ref",
+					Usage: "deploy the given commit, tag or branch instead of the configured branch",
+				},
+			},
+		},
+		{
+			Name:   "supervise",
+			Usage:  "run and supervise the processes of the current release",
+			Action: superviseCommand,
+			Flags: []cli.Flag{
+				fileFlag(),
+			},
+		},
+		{
+			Name:   "proxy",
+			Usage:  "run the reverse proxy for blue/green deployments",
+			Action: proxyCommand,
+			Flags: []cli.Flag{
+				fileFlag(),
+				&cli.StringFlag{
+					Name:  "listen",
+					Usage: "address to listen on, overrides deploy.bluegreen.listen",
+				},
+			},
+		},
+		{
+			Name:  "maintenance",
+			Usage: "manage maintenance mode",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "on",
+					Usage:  "enable maintenance mode",
+					Action: maintenanceOnCommand,
+					Flags:  []cli.Flag{fileFlag()},
+				},
+				{
+					Name:   "off",
+					Usage:  "disable maintenance mode",
+					Action: maintenanceOffCommand,
+					Flags:  []cli.Flag{fileFlag()},
+				},
+				{
+					Name:   "status",
+					Usage:  "show whether maintenance mode is enabled",
+					Action: maintenanceStatusCommand,
+					Flags:  []cli.Flag{fileFlag()},
+				},
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "manage the shared git object cache",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "gc",
+					Usage:  "remove unused caches and prune the others",
+					Action: cacheGCCommand,
+					Flags: []cli.Flag{
+						fileFlag(),
+						&cli.StringFlag{
+							Name:  "dir",
+							Usage: "cache directory, overrides source.git.cache",
+						},
+						&cli.DurationFlag{
+							Name:  "max-age",
+							Usage: "remove caches that haven't been used for this long, 0 keeps them",
+							Value: 30 * 24 * time.Hour,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:      "sign",
+			Usage:     "sign artifacts for the archive provider",
+			ArgsUsage: "FILE...",
+			Action:    signCommand,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "key",
+					Aliases: []string{"k"},
+					Usage:   "path to the secret key, defaults to the key in $" + signingKeyEnv,
+				},
+				&cli.StringFlag{
+					Name:  "version",
+					Usage: "version of the artifact, signed together with the file as the manifest version the archive provider expects",
+				},
+				&cli.StringFlag{
+					Name:  "comment",
+					Usage: "trusted comment, signed together with the file, replaces the default comment",
+				},
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:   "keygen",
+					Usage:  "generate a new key pair",
+					Action: signKeygenCommand,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "public-key",
+							Usage: "path to write the public key to",
+							Value: "deploy.pub",
+						},
+						&cli.StringFlag{
+							Name:  "secret-key",
+							Usage: "path to write the secret key to",
+							Value: "deploy.key",
+						},
+					},
+				},
 			},
 		},
 		{
@@ -66,6 +192,12 @@ var app = &cli.App{
 }
 
 func main() {
+	// git runs the binary itself to ask for the credentials of the app
+	if git.IsAskpass() {
+		git.Askpass(os.Args)
+		return
+	}
+
 	if err := app.Run(os.Args); err != nil {
 		log.Fatal(err)
 	}
@@ -86,28 +218,11 @@ func initCommand(c *cli.Context) error {
 }
 
 func startCommand(c *cli.Context) error {
-	var configPath string
-	if c.String("file") != "" {
-		configPath = c.String("file")
-	} else {
-		configPath = "config.toml"
-	}
-
-	configPath, err := filepath.Abs(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to resolve config path: %w", err)
-	}
-
-	cfg, err := config.Load(configPath)
+	cfg, appDir, err := loadConfig(c)
 	if err != nil {
 		return err
 	}
 
-	appDir, err := filepath.Abs(filepath.Dir(configPath))
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path: %w", err)
-	}
-
 	logger, err := logger.New(appDir)
 	if err != nil {
 		return fmt.Errorf("failed to create logger: %w", err)
@@ -124,6 +239,7 @@ func startCommand(c *cli.Context) error {
 		Provider: p,
 		AppDir:   appDir,
 		Force:    c.Bool("force"),
+		Ref:      c.String("ref"),
 	}
 
 	deployer := deployer.New()
@@ -135,6 +251,284 @@ func startCommand(c *cli.Context) error {
 	return nil
 }
 
+func superviseCommand(c *cli.Context) error {
+	cfg, appDir, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	logger, err := logger.New(appDir)
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %w", err)
+	}
+
+	s, err := supervisor.New(cfg, appDir, logger)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(c.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return s.Run(ctx)
+}
+
+func proxyCommand(c *cli.Context) error {
+	cfg, appDir, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	logger, err := logger.New(appDir)
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %w", err)
+	}
+
+	listen := cfg.Deploy.BlueGreen.Listen
+	if c.String("listen") != "" {
+		listen = c.String("listen")
+	}
+	if listen == "" {
+		listen = ":8080"
+	}
+
+	ctx, stop := signal.NotifyContext(c.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return bluegreen.NewProxy(appDir, logger).ListenAndServe(ctx, listen)
+}
+
+func maintenanceOnCommand(c *cli.Context) error {
+	cfg, appDir, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	// a running deployment manages maintenance mode itself
+	if err := lock.Acquire(appDir); err != nil {
+		return err
+	}
+	defer lock.Release(appDir)
+
+	if err := maintenance.Enable(appDir, cfg.Deploy.Maintenance); err != nil {
+		return err
+	}
+
+	fmt.Println("maintenance mode enabled")
+
+	return nil
+}
+
+func maintenanceOffCommand(c *cli.Context) error {
+	cfg, appDir, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	// a running deployment manages maintenance mode itself
+	if err := lock.Acquire(appDir); err != nil {
+		return err
+	}
+	defer lock.Release(appDir)
+
+	if err := maintenance.Disable(appDir, cfg.Deploy.Maintenance); err != nil {
+		return err
+	}
+
+	fmt.Println("maintenance mode disabled")
+
+	return nil
+}
+
+func maintenanceStatusCommand(c *cli.Context) error {
+	cfg, appDir, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	enabled, err := maintenance.Enabled(appDir, cfg.Deploy.Maintenance)
+	if err != nil {
+		return fmt.Errorf("failed to check maintenance mode: %w", err)
+	}
+
+	if enabled {
+		fmt.Println("maintenance mode is on")
+	} else {
+		fmt.Println("maintenance mode is off")
+	}
+
+	return nil
+}
+
+func cacheGCCommand(c *cli.Context) error {
+	cacheDir := c.String("dir")
+	if cacheDir == "" {
+		cfg, appDir, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		if cfg.Source.Git.Cache == "" {
+			return fmt.Errorf("no cache configured, set source.git.cache or use --dir")
+		}
+
+		cacheDir = cfg.Source.Git.Cache
+		if !filepath.IsAbs(cacheDir) {
+			cacheDir = filepath.Join(appDir, cacheDir)
+		}
+	}
+
+	result, err := git.GC(cacheDir, c.Duration("max-age"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range result.Removed {
+		fmt.Printf("removed %s\n", path)
+	}
+	for _, path := range result.Collected {
+		fmt.Printf("collected %s\n", path)
+	}
+	for _, path := range result.Kept {
+		fmt.Printf("kept %s, still linked to a source checkout\n", path)
+	}
+
+	return nil
+}
+
+// signingKeyEnv holds the secret key in CI, where it is usually a secret
+// variable rather than a file
+const signingKeyEnv = "DEPLOY_SIGNING_KEY"
+
+func signCommand(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("no files to sign")
+	}
+
+	var secretKey []byte
+	if c.String("key") != "" {
+		data, err := os.ReadFile(c.String("key"))
+		if err != nil {
+			return fmt.Errorf("failed to read secret key: %w", err)
+		}
+		secretKey = data
+	} else if value := os.Getenv(signingKeyEnv); value != "" {
+		secretKey = []byte(value)
+	} else {
+		return fmt.Errorf("no secret key, use --key or set %s", signingKeyEnv)
+	}
+
+	if c.String("comment") != "" && c.String("version") != "" {
+		return fmt.Errorf("--comment and --version can't be combined, add version:VERSION to the comment")
+	}
+
+	for _, file := range c.Args().Slice() {
+		comment := c.String("comment")
+		if comment == "" {
+			comment = signature.TrustedComment(file, c.String("version"))
+		}
+
+		sig, err := signature.Sign(file, secretKey, comment)
+		if err != nil {
+			return fmt.Errorf("failed to sign %s: %w", file, err)
+		}
+
+		if err := os.WriteFile(file+".minisig", sig, 0644); err != nil {
+			return fmt.Errorf("failed to write signature: %w", err)
+		}
+
+		fmt.Printf("signed %s, signature written to %s.minisig\n", file, file)
+	}
+
+	return nil
+}
+
+func signKeygenCommand(c *cli.Context) error {
+	publicKey, secretKey, err := signature.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+
+	// never overwrite an existing key, and never leave half a key pair behind
+	keys := []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{c.String("public-key"), publicKey, 0644},
+		{c.String("secret-key"), secretKey, 0600},
+	}
+	for _, key := range keys {
+		if _, err := os.Lstat(key.path); err == nil {
+			return fmt.Errorf("failed to write key: %s already exists", key.path)
+		}
+	}
+
+	var written []string
+	for _, key := range keys {
+		if err := writeNewFile(key.path, key.data, key.perm); err != nil {
+			for _, path := range written {
+				os.Remove(path)
+			}
+			return fmt.Errorf("failed to write key: %w", err)
+		}
+		written = append(written, key.path)
+	}
+
+	fmt.Printf("secret key written to %s, keep it secret\n", c.String("secret-key"))
+	fmt.Printf("public key written to %s, add it to source.signature.public_keys:\n%s", c.String("public-key"), publicKey)
+
+	return nil
+}
+
+// writeNewFile writes the file, failing if it already exists. A partially
+// written file is removed.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
+
+// loadConfig loads the configuration file given with the --file flag, or
+// config.toml in the working directory, and returns it together with the
+// application directory it is in.
+func loadConfig(c *cli.Context) (*config.Config, string, error) {
+	var configPath string
+	if c.String("file") != "" {
+		configPath = c.String("file")
+	} else {
+		configPath = "config.toml"
+	}
+
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve config path: %w", err)
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	appDir, err := filepath.Abs(filepath.Dir(configPath))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	return cfg, appDir, nil
+}
+
 func versionCommand(c *cli.Context) error {
 	fmt.Printf("Version:    %s\n", version)
 	fmt.Printf("Commit:     %s\n", commit)
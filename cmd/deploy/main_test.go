@@ -1,94 +1,2186 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"github.com/serversfordev/deploy/internal/bluegreen"
 	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/provider/git"
+	"github.com/serversfordev/deploy/internal/provider/s3"
+	"github.com/serversfordev/deploy/internal/release"
 )
 
 var (
 	workingDir string
 )
 
+// TestMain lets the test binary act as the askpass program, like the deploy
+// binary does.
+func TestMain(m *testing.M) {
+	if git.IsAskpass() {
+		git.Askpass(os.Args)
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestDeploy(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Deploy test suite")
 }
 
-var _ = BeforeSuite(func() {
-	var err error
+var _ = BeforeSuite(func() {
+	var err error
+
+	workingDir, err = os.Getwd()
+	Expect(err).NotTo(HaveOccurred())
+
+	workingDir = filepath.Join(workingDir, "testdata")
+	Expect(err).NotTo(HaveOccurred())
+
+	err = os.RemoveAll(workingDir)
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = Describe("Deploy", func() {
+	Context("init command", func() {
+		It("should create a new application deployment structure", func() {
+			// create a new test environment
+			env, err := NewTestEnv(workingDir, "init-test-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.Dir).To(BeADirectory())
+
+			// change working directory to the test environment
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// run the init command
+			err = app.Run([]string{"deploy", "init", "-n", "app"})
+			Expect(err).NotTo(HaveOccurred())
+
+			// check that the application structure was created
+			Expect(filepath.Join(env.Dir, "app")).To(BeADirectory())
+			Expect(filepath.Join(env.Dir, "app", "releases")).To(BeADirectory())
+			Expect(filepath.Join(env.Dir, "app", "shared")).To(BeADirectory())
+			Expect(filepath.Join(env.Dir, "app", "logs")).To(BeADirectory())
+			Expect(filepath.Join(env.Dir, "app", "config.toml")).To(BeAnExistingFile())
+
+			// check that the config file was created with the correct content
+			generatedConfig, err := config.Load(filepath.Join(env.Dir, "app", "config.toml"))
+			Expect(err).NotTo(HaveOccurred())
+
+			defaultConfig := config.Default()
+			Expect(generatedConfig).To(Equal(defaultConfig))
+		})
+	})
+
+	Context("deploy command", func() {
+		It("should successfully deploy", func() {
+			// create a new test environment
+			env, err := NewTestEnv(workingDir, "deploy-test-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.Dir).To(BeADirectory())
+
+			// change working directory to the test environment
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// init the app
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			// commit a file
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			// start the deployment
+			err = app.Run([]string{"deploy", "start", "-f", filepath.Join(env.Dir, "app", "config.toml")})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should recover from a rewritten history and a corrupted checkout", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-force-push-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitFile("test2.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			// rewrite the history of the branch
+			repoDir := filepath.Join(env.Dir, "repo")
+			err = runGitCommand(repoDir, "reset", "--hard", "HEAD~1")
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitFile("test3.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "test3.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "test2.txt")).NotTo(BeAnExistingFile())
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKey("history_rewritten"))
+
+			// break the source checkout
+			err = os.RemoveAll(filepath.Join(env.Dir, "app", ".git", ".git", "objects"))
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitFile("test4.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "test4.txt")).To(BeAnExistingFile())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("source history rewritten"))
+			Expect(log).To(ContainSubstring("source recloned"))
+		})
+
+		It("should deploy a specific ref", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-ref-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {})
+			Expect(err).NotTo(HaveOccurred())
+
+			repoDir := filepath.Join(env.Dir, "repo")
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "tag", "v1.0.0")
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitFile("test2.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "test2.txt")).To(BeAnExistingFile())
+
+			err = env.Deploy("--ref", "v1.0.0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "test1.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "test2.txt")).NotTo(BeAnExistingFile())
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Ref).To(Equal("v1.0.0"))
+			Expect(metadata.Pinned).To(BeTrue())
+
+			// the pinned release is compared against the ref, not the branch
+			err = env.Deploy("--ref", "v1.0.0")
+			Expect(err).NotTo(HaveOccurred())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("no changes detected, skipping deployment"))
+
+			// a ref is never taken for an option of git
+			err = env.Deploy("--ref=--upload-pack=touch pwned")
+			Expect(err).NotTo(HaveOccurred())
+
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring(`invalid ref "--upload-pack=touch pwned"`))
+			Expect(filepath.Join(env.Dir, "app", ".git", "pwned")).NotTo(BeAnExistingFile())
+		})
+
+		It("should deploy the highest tag matching the constraint", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-tags-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Tags = ">=2.0.0 <3.0.0"
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			repoDir := filepath.Join(env.Dir, "repo")
+			for _, tag := range []string{"v1.0.0", "v2.0.0", "v2.1.0-rc.1", "v3.0.0"} {
+				err = env.CommitFile(tag + ".txt")
+				Expect(err).NotTo(HaveOccurred())
+				err = runGitCommand(repoDir, "tag", tag)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "v2.0.0.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "v2.1.0-rc.1.txt")).NotTo(BeAnExistingFile())
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKeyWithValue("tag", "v2.0.0"))
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Tags = ">=2.0.0 <3.0.0"
+				cfg.Source.Git.Prerelease = true
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "v2.1.0-rc.1.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "v3.0.0.txt")).NotTo(BeAnExistingFile())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("source tag: v2.1.0-rc.1"))
+
+			// a pre-release is lower than its release
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Tags = ">=2.1.0 <3.0.0"
+				cfg.Source.Git.Prerelease = true
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("no tag matches >=2.1.0 <3.0.0"))
+
+			// wildcards are constraints, not globs
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Tags = "2.*"
+				cfg.Source.Git.Prerelease = false
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "v2.1.0-rc.1.txt")).NotTo(BeAnExistingFile())
+
+			metadata, err = release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKeyWithValue("tag", "v2.0.0"))
+		})
+
+		It("should deploy a subdirectory and watch its paths", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-monorepo-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Path = "apps/api"
+				cfg.Source.Git.WatchPaths = []string{"apps/api", "libs"}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitContent("apps/api/main.txt", "api v1", 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitContent("apps/web/index.txt", "web v1", 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "main.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "apps")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(env.Dir, "app", ".git", "apps", "web")).NotTo(BeAnExistingFile())
+
+			firstRelease, err := os.Readlink(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// a change of another app doesn't trigger a deployment
+			err = env.CommitContent("apps/web/index.txt", "web v2", 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentRelease, err := os.Readlink(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(currentRelease).To(Equal(firstRelease))
+
+			// a change of a watched path does
+			err = env.CommitContent("libs/shared.txt", "shared v1", 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentRelease, err = os.Readlink(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(currentRelease).NotTo(Equal(firstRelease))
+		})
+
+		It("should export submodules into the release", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-submodules-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// git refuses local submodules by default
+			os.Setenv("GIT_CONFIG_COUNT", "1")
+			os.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+			os.Setenv("GIT_CONFIG_VALUE_0", "always")
+			DeferCleanup(func() {
+				os.Unsetenv("GIT_CONFIG_COUNT")
+				os.Unsetenv("GIT_CONFIG_KEY_0")
+				os.Unsetenv("GIT_CONFIG_VALUE_0")
+			})
+
+			libDir := filepath.Join(env.Dir, "lib")
+			err = os.MkdirAll(libDir, 0755)
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(libDir, "init", "--initial-branch", "main")
+			Expect(err).NotTo(HaveOccurred())
+			err = os.WriteFile(filepath.Join(libDir, "lib.txt"), []byte("lib"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(libDir, "add", "lib.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(libDir, "commit", "-m", "add lib.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			repoDir := filepath.Join(env.Dir, "repo")
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "submodule", "add", libDir, "vendor/lib")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "commit", "-m", "add submodule")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Submodules = true
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "vendor", "lib", "lib.txt")).To(BeAnExistingFile())
+
+			libRevision, err := exec.Command("git", "-C", libDir, "rev-parse", "HEAD").Output()
+			Expect(err).NotTo(HaveOccurred())
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKeyWithValue("submodule vendor/lib", strings.TrimSpace(string(libRevision))))
+		})
+
+		It("should fail clearly when lfs is enabled without git-lfs", func() {
+			if _, err := exec.LookPath("git-lfs"); err == nil {
+				Skip("git-lfs is installed")
+			}
+
+			env, err := NewTestEnv(workingDir, "deploy-test-lfs-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.LFS = true
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current")).NotTo(BeAnExistingFile())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("lfs is enabled but git-lfs is not installed"))
+		})
+
+		It("should authenticate with a token over https", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-auth-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			gitPath, err := exec.LookPath("git")
+			Expect(err).NotTo(HaveOccurred())
+
+			// serve the test repository over smart http behind basic auth
+			backend := &cgi.Handler{
+				Path: gitPath,
+				Args: []string{"http-backend"},
+				Env:  []string{"GIT_PROJECT_ROOT=" + env.Dir, "GIT_HTTP_EXPORT_ALL=1"},
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				username, password, ok := r.BasicAuth()
+				if !ok || username != "deployer" || password != "secret-token" {
+					w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				backend.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Repo = server.URL + "/repo"
+				cfg.Source.Git.Auth = config.GitAuthConfig{
+					Username: "deployer",
+					TokenEnv: "DEPLOY_TEST_TOKEN",
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			// a missing token fails before git is run
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current")).NotTo(BeAnExistingFile())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("token environment variable DEPLOY_TEST_TOKEN is not set"))
+
+			os.Setenv("DEPLOY_TEST_TOKEN", "secret-token")
+			DeferCleanup(func() { os.Unsetenv("DEPLOY_TEST_TOKEN") })
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current", "test1.txt")).To(BeAnExistingFile())
+		})
+
+		It("should deploy from a bare repository with the native backend", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-native-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			repoDir := filepath.Join(env.Dir, "repo")
+			bareDir := filepath.Join(env.Dir, "repo.git")
+			push := func() {
+				err := runGitCommand(repoDir, "push", "--force", "--tags", bareDir, "main")
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(env.Dir, "init", "--bare", bareDir)
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "tag", "v1.0.0")
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitHook("build", "#!/bin/sh\necho built > built.txt\n")
+			Expect(err).NotTo(HaveOccurred())
+			push()
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Repo = bareDir
+				cfg.Source.Git.Backend = "native"
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			// the executable bit of the hook survives the export
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "test1.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "built.txt")).To(BeAnExistingFile())
+
+			revision, err := exec.Command("git", "-C", repoDir, "rev-parse", "HEAD").Output()
+			Expect(err).NotTo(HaveOccurred())
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Revision).To(Equal(strings.TrimSpace(string(revision))))
+
+			// a force-push is picked up
+			err = runGitCommand(repoDir, "reset", "--hard", "v1.0.0")
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitFile("test2.txt")
+			Expect(err).NotTo(HaveOccurred())
+			push()
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "test2.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "built.txt")).NotTo(BeAnExistingFile())
+
+			metadata, err = release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKey("history_rewritten"))
+
+			err = env.Deploy("--ref", "v1.0.0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "test1.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "test2.txt")).NotTo(BeAnExistingFile())
+
+			// the fetch errors explain a ref that can't be resolved
+			err = env.Deploy("--ref", "missing")
+			Expect(err).NotTo(HaveOccurred())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(MatchRegexp(`failed to resolve ref: failed to resolve ref missing: .*failed to fetch branch`))
+		})
+
+		It("should skip the fetch when the remote revision is already deployed", func() {
+			for _, backend := range []string{"exec", "native"} {
+				env, err := NewTestEnv(workingDir, "deploy-test-remote-revision-"+backend)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = os.Chdir(env.Dir)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = env.InitApp()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.ConfigureApp(func(cfg *config.Config) {
+					cfg.Source.Git.Backend = backend
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.CommitFile("test1.txt")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+
+				// a marker in the source checkout survives only if there was no fetch
+				marker := filepath.Join(env.Dir, "app", ".git", "untracked.txt")
+				err = os.WriteFile(marker, []byte("untracked"), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(marker).To(BeAnExistingFile())
+
+				log, err := env.ReadLog()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(log).To(ContainSubstring("remote revision is already deployed, skipping deployment"))
+
+				err = env.CommitFile("test2.txt")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(marker).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(env.Dir, "app", "current", "test2.txt")).To(BeAnExistingFile())
+			}
+		})
+
+		It("should skip the fetch when the matching tag is already deployed", func() {
+			for _, backend := range []string{"exec", "native"} {
+				env, err := NewTestEnv(workingDir, "deploy-test-remote-tag-"+backend)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = os.Chdir(env.Dir)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = env.InitApp()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.ConfigureApp(func(cfg *config.Config) {
+					cfg.Source.Git.Backend = backend
+					cfg.Source.Git.Tags = ">=1.0.0"
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// annotated tags are compared by the commits they point to
+				repoDir := filepath.Join(env.Dir, "repo")
+				err = env.CommitFile("test1.txt")
+				Expect(err).NotTo(HaveOccurred())
+				err = runGitCommand(repoDir, "tag", "--annotate", "--message", "v1.0.0", "v1.0.0")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+
+				marker := filepath.Join(env.Dir, "app", ".git", "untracked.txt")
+				err = os.WriteFile(marker, []byte("untracked"), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				// a commit on the branch doesn't change the tag to deploy
+				err = env.CommitFile("test2.txt")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(marker).To(BeAnExistingFile())
+
+				log, err := env.ReadLog()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(log).To(ContainSubstring("remote revision is already deployed, skipping deployment"))
+
+				err = runGitCommand(repoDir, "tag", "--annotate", "--message", "v1.1.0", "v1.1.0")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(marker).NotTo(BeAnExistingFile())
+
+				metadata, err := release.ReadMetadata(filepath.Join(env.Dir, "app", "current"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(metadata.Source).To(HaveKeyWithValue("tag", "v1.1.0"))
+			}
+		})
+
+		It("should fall back to a mirror when the repository is unavailable", func() {
+			for _, backend := range []string{"exec", "native"} {
+				env, err := NewTestEnv(workingDir, "deploy-test-mirror-"+backend)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = os.Chdir(env.Dir)
+				Expect(err).NotTo(HaveOccurred())
+
+				status := http.StatusServiceUnavailable
+				primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(status)
+				}))
+				defer primary.Close()
+
+				_, err = env.InitApp()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.ConfigureApp(func(cfg *config.Config) {
+					cfg.Source.Git.Mirrors = []string{cfg.Source.Git.Repo}
+					cfg.Source.Git.Repo = primary.URL + "/repo"
+					cfg.Source.Git.Backend = backend
+					cfg.Source.Git.RetryBackoff = "10ms"
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.CommitFile("test1.txt")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+
+				currentDir := filepath.Join(env.Dir, "app", "current")
+				Expect(filepath.Join(currentDir, "test1.txt")).To(BeAnExistingFile())
+
+				metadata, err := release.ReadMetadata(currentDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(metadata.Source).To(HaveKeyWithValue("mirror", filepath.Join(env.Dir, "repo")))
+
+				// a permanent error doesn't fall back
+				status = http.StatusNotFound
+				err = env.CommitFile("test2.txt")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = env.Deploy()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(currentDir, "test2.txt")).NotTo(BeAnExistingFile())
+			}
+		})
+
+		It("should share a git object cache between apps", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-cache-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			cacheDir := filepath.Join(env.Dir, "cache")
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Git.Cache = cacheDir
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// a second app of the same repository, e.g. staging and production
+			err = app.Run([]string{"deploy", "init", "-n", "staging"})
+			Expect(err).NotTo(HaveOccurred())
+			configData, err := os.ReadFile(filepath.Join(env.Dir, "app", "config.toml"))
+			Expect(err).NotTo(HaveOccurred())
+			err = os.WriteFile(filepath.Join(env.Dir, "staging", "config.toml"), configData, 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, name := range []string{"app", "staging"} {
+				err = app.Run([]string{"deploy", "start", "-f", filepath.Join(env.Dir, name, "config.toml")})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(env.Dir, name, "current", "test1.txt")).To(BeAnExistingFile())
+
+				// the objects of the checkout come from the cache
+				alternates := filepath.Join(env.Dir, name, ".git", ".git", "objects", "info", "alternates")
+				Expect(alternates).To(BeAnExistingFile())
+				objects, err := exec.Command("git", "-C", filepath.Join(env.Dir, name, ".git"), "count-objects").Output()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(objects)).To(HavePrefix("0 objects"))
+			}
+
+			caches, err := filepath.Glob(filepath.Join(cacheDir, "*.git"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(caches).To(HaveLen(1))
+
+			err = app.Run([]string{"deploy", "cache", "gc", "--dir", cacheDir})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(caches[0]).To(BeADirectory())
+
+			// an unused cache is kept while checkouts link to it
+			err = app.Run([]string{"deploy", "cache", "gc", "-f", filepath.Join(env.Dir, "app", "config.toml"), "--max-age", "1ns"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(caches[0]).To(BeADirectory())
+
+			err = os.RemoveAll(filepath.Join(env.Dir, "staging"))
+			Expect(err).NotTo(HaveOccurred())
+			err = os.RemoveAll(filepath.Join(env.Dir, "app", ".git"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = app.Run([]string{"deploy", "cache", "gc", "-f", filepath.Join(env.Dir, "app", "config.toml"), "--max-age", "1ns"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(caches[0]).NotTo(BeADirectory())
+
+			// a removed cache is fetched again
+			err = env.CommitFile("test2.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current", "test2.txt")).To(BeAnExistingFile())
+			Expect(caches[0]).To(BeADirectory())
+		})
+
+		It("should deploy from git bundles dropped into an inbox", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-bundle-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			repoDir := filepath.Join(env.Dir, "repo")
+			inboxDir := filepath.Join(env.Dir, "inbox")
+			err = os.MkdirAll(inboxDir, 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Provider = "bundle"
+				cfg.Source.Bundle.Inbox = inboxDir
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "tag", "v1")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "bundle", "create", filepath.Join(inboxDir, "0001.bundle"), "main", "v1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "test1.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(inboxDir, "0001.bundle")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(inboxDir, "processed", "0001.bundle")).To(BeAnExistingFile())
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKeyWithValue("bundles", "0001.bundle"))
+
+			// nothing new in the inbox
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("remote revision is already deployed, skipping deployment"))
+
+			// an incremental bundle
+			err = env.CommitFile("test2.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "bundle", "create", filepath.Join(inboxDir, "0002.bundle"), "v1..main")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "test2.txt")).To(BeAnExistingFile())
+
+			// an incremental bundle missing the commits it builds on stays in the inbox
+			err = runGitCommand(repoDir, "tag", "v2")
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitFile("test3.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "tag", "v3")
+			Expect(err).NotTo(HaveOccurred())
+			err = env.CommitFile("test4.txt")
+			Expect(err).NotTo(HaveOccurred())
+			err = runGitCommand(repoDir, "bundle", "create", filepath.Join(inboxDir, "0004.bundle"), "v3..main")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "test4.txt")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(inboxDir, "0004.bundle")).To(BeAnExistingFile())
+
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("failed to verify bundle 0004.bundle"))
+
+			err = runGitCommand(repoDir, "bundle", "create", filepath.Join(inboxDir, "0003.bundle"), "v2..v3")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentDir, "test4.txt")).To(BeAnExistingFile())
+		})
+
+		It("should deploy a local directory", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-dir-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			srcDir := filepath.Join(env.Dir, "src")
+			files := map[string]string{
+				"app.txt":             "app",
+				"debug.log":           "ignored",
+				"tmp/cache.txt":       "ignored",
+				".deployignore":       "*.log\ntmp/\n",
+				".deploy/hooks/build": "#!/bin/sh\necho built > built.txt\n",
+			}
+			for name, content := range files {
+				path := filepath.Join(srcDir, name)
+				Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+				Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+			}
+			Expect(os.Chmod(filepath.Join(srcDir, ".deploy", "hooks", "build"), 0755)).To(Succeed())
+			Expect(os.Symlink("app.txt", filepath.Join(srcDir, "link.txt"))).To(Succeed())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Provider = "dir"
+				cfg.Source.Dir.Path = srcDir
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "app.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "built.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "debug.log")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "tmp")).NotTo(BeAnExistingFile())
+
+			link, err := os.Readlink(filepath.Join(currentDir, "link.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("app.txt"))
+
+			info, err := os.Stat(filepath.Join(currentDir, ".deploy", "hooks", "build"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+
+			// changes to ignored files don't make a new revision
+			err = os.WriteFile(filepath.Join(srcDir, "debug.log"), []byte("changed"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("remote revision is already deployed, skipping deployment"))
+
+			err = os.WriteFile(filepath.Join(srcDir, "app.txt"), []byte("changed"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			content, err := os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("changed"))
+		})
+
+		It("should deploy a verified artifact named by a manifest", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-archive-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			artifactsDir := filepath.Join(env.Dir, "artifacts")
+			err = os.MkdirAll(artifactsDir, 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			var ranges []string
+			fileServer := http.FileServer(http.Dir(artifactsDir))
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					ranges = append(ranges, r.Header.Get("Range"))
+				}
+				fileServer.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			publish := func(version, name string, entries []archiveEntry, checksum string) {
+				sum, err := createArchive(filepath.Join(artifactsDir, name), entries)
+				Expect(err).NotTo(HaveOccurred())
+				if checksum == "" {
+					checksum = sum
+				}
+				manifest := fmt.Sprintf(`{"version": %q, "url": %q, "sha256": %q}`, version, name, checksum)
+				err = os.WriteFile(filepath.Join(artifactsDir, "manifest.json"), []byte(manifest), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Provider = "archive"
+				cfg.Source.Archive.Manifest = server.URL + "/manifest.json"
+				cfg.Source.Archive.StripComponents = 1
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			publish("1.0.0", "app-1.0.0.tar.gz", []archiveEntry{
+				{Name: "app/app.txt", Content: "1.0.0"},
+				{Name: "app/.deploy/hooks/build", Content: "#!/bin/sh\necho built > built.txt\n", Mode: 0755},
+				{Name: "app/link.txt", Link: "app.txt"},
+			}, "")
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "app.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "built.txt")).To(BeAnExistingFile())
+			link, err := os.Readlink(filepath.Join(currentDir, "link.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("app.txt"))
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Revision).To(Equal("1.0.0"))
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("remote revision is already deployed, skipping deployment"))
+
+			// an interrupted download is resumed
+			publish("1.1.0", "app-1.1.0.tar.zst", []archiveEntry{
+				{Name: "app/app.txt", Content: strings.Repeat("1.1.0", 1000)},
+			}, "")
+			data, err := os.ReadFile(filepath.Join(artifactsDir, "app-1.1.0.tar.zst"))
+			Expect(err).NotTo(HaveOccurred())
+			sum := sha256.Sum256(data)
+			partial := filepath.Join(env.Dir, "app", ".artifacts", hex.EncodeToString(sum[:])+".zst.partial")
+			err = os.WriteFile(partial, data[:len(data)/2], 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			content, err := os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal(strings.Repeat("1.1.0", 1000)))
+			Expect(ranges).To(ContainElement(fmt.Sprintf("bytes=%d-", len(data)/2)))
+
+			// a checksum mismatch stops before a release is created
+			publish("1.2.0", "app-1.2.0.zip", []archiveEntry{
+				{Name: "app/app.txt", Content: "1.2.0"},
+			}, strings.Repeat("0", 64))
+
+			releases, err := os.ReadDir(filepath.Join(env.Dir, "app", "releases"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("checksum mismatch for artifact"))
+			Expect(os.ReadDir(filepath.Join(env.Dir, "app", "releases"))).To(HaveLen(len(releases)))
+
+			// entries escaping the release fail the extraction
+			publish("1.3.0", "app-1.3.0.tar.gz", []archiveEntry{
+				{Name: "app/escape", Link: "../../.."},
+				{Name: "app/escape/evil.txt", Content: "evil"},
+			}, "")
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("points outside of the target directory"))
+			content, err = os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal(strings.Repeat("1.1.0", 1000)))
+
+			publish("1.4.0", "app-1.4.0.zip", []archiveEntry{
+				{Name: "app/app.txt", Content: "1.4.0"},
+			}, "")
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			content, err = os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.4.0"))
+		})
+
+		It("should verify the signature of the artifact before extracting it", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-signature-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			artifactsDir := filepath.Join(env.Dir, "artifacts")
+			err = os.MkdirAll(artifactsDir, 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			keyFile := filepath.Join(env.Dir, "deploy.key")
+			pubFile := filepath.Join(env.Dir, "deploy.pub")
+			err = app.Run([]string{"deploy", "sign", "keygen", "--secret-key", keyFile, "--public-key", pubFile})
+			Expect(err).NotTo(HaveOccurred())
+			publicKey, err := os.ReadFile(pubFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			untrustedKeyFile := filepath.Join(env.Dir, "untrusted.key")
+			err = app.Run([]string{"deploy", "sign", "keygen", "--secret-key", untrustedKeyFile, "--public-key", filepath.Join(env.Dir, "untrusted.pub")})
+			Expect(err).NotTo(HaveOccurred())
+
+			// an existing key is never overwritten, nor is half a key pair written
+			err = app.Run([]string{"deploy", "sign", "keygen", "--secret-key", filepath.Join(env.Dir, "other.key"), "--public-key", pubFile})
+			Expect(err).To(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "other.key")).NotTo(BeAnExistingFile())
+
+			// a raw ed25519 key, e.g. the next key of a rotation
+			rawPublicKey, rawPrivateKey, err := ed25519.GenerateKey(nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			publish := func(version string, signature string) string {
+				name := "app-" + version + ".tar.gz"
+				sum, err := createArchive(filepath.Join(artifactsDir, name), []archiveEntry{
+					{Name: "app.txt", Content: version},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				manifest := fmt.Sprintf(`{"version": %q, "url": %q, "sha256": %q, "signature": %q}`, version, name, sum, signature)
+				err = os.WriteFile(filepath.Join(artifactsDir, "manifest.json"), []byte(manifest), 0644)
+				Expect(err).NotTo(HaveOccurred())
+				return filepath.Join(artifactsDir, name)
+			}
+
+			releaseCount := func() int {
+				releases, err := os.ReadDir(filepath.Join(env.Dir, "app", "releases"))
+				Expect(err).NotTo(HaveOccurred())
+				return len(releases)
+			}
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Provider = "archive"
+				cfg.Source.Archive.Manifest = filepath.Join(artifactsDir, "manifest.json")
+				cfg.Source.Signature.PublicKeys = []string{
+					string(publicKey),
+					base64.StdEncoding.EncodeToString(rawPublicKey),
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			artifact := publish("1.0.0", "")
+			err = app.Run([]string{"deploy", "sign", "-k", keyFile, "--version", "1.0.0", artifact})
+			Expect(err).NotTo(HaveOccurred())
+			firstArtifact := artifact
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			Expect(filepath.Join(currentDir, "app.txt")).To(BeAnExistingFile())
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKey("signed_by"))
+			Expect(string(publicKey)).To(ContainSubstring(metadata.Source["signed_by"]))
+
+			// an unsigned artifact
+			publish("1.1.0", "")
+			releases := releaseCount()
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("failed to read signature"))
+			Expect(releaseCount()).To(Equal(releases))
+
+			// an artifact signed by an untrusted key
+			artifact = publish("1.2.0", "")
+			err = app.Run([]string{"deploy", "sign", "-k", untrustedKeyFile, "--version", "1.2.0", artifact})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("signed by untrusted key"))
+			Expect(releaseCount()).To(Equal(releases))
+
+			// an older signed artifact replayed as a new version
+			data, err := os.ReadFile(firstArtifact)
+			Expect(err).NotTo(HaveOccurred())
+			sum := sha256.Sum256(data)
+			manifest := fmt.Sprintf(`{"version": "1.2.1", "url": "app-1.0.0.tar.gz", "sha256": %q}`, hex.EncodeToString(sum[:]))
+			err = os.WriteFile(filepath.Join(artifactsDir, "manifest.json"), []byte(manifest), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring(`signed for version "1.0.0", not "1.2.1"`))
+			Expect(releaseCount()).To(Equal(releases))
+
+			// a raw ed25519 signature of the rotated key
+			artifact = publish("1.3.0", "app-1.3.0.tar.gz.sig")
+			data, err = os.ReadFile(artifact)
+			Expect(err).NotTo(HaveOccurred())
+			sig := base64.StdEncoding.EncodeToString(ed25519.Sign(rawPrivateKey, data))
+			err = os.WriteFile(artifact+".sig", []byte(sig), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			content, err := os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.3.0"))
+		})
+
+		It("should deploy the newest artifact from an s3 bucket", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-s3-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// a local MinIO is used if configured, otherwise a fake storage
+			endpoint := os.Getenv("DEPLOY_TEST_S3_ENDPOINT")
+			bucket := os.Getenv("DEPLOY_TEST_S3_BUCKET")
+			prefix := fmt.Sprintf("deploy-test-%d/", time.Now().UnixNano())
+			if endpoint == "" {
+				accessKey, secretKey := "test-access-key", "test-secret-key"
+				os.Setenv("DEPLOY_TEST_S3_ACCESS_KEY", accessKey)
+				os.Setenv("DEPLOY_TEST_S3_SECRET_KEY", secretKey)
+				bucket = "deploy"
+
+				objects := map[string][]byte{}
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+accessKey+"/") {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+
+					key, ok := strings.CutPrefix(r.URL.Path, "/"+bucket+"/")
+					if !ok {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+
+					switch {
+					case r.Method == http.MethodPut:
+						data, _ := io.ReadAll(r.Body)
+						objects[key] = data
+					case key == "" && r.URL.Query().Get("list-type") == "2":
+						var list strings.Builder
+						list.WriteString("<ListBucketResult>")
+						for name, data := range objects {
+							if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+								fmt.Fprintf(&list, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", name, len(data))
+							}
+						}
+						list.WriteString("<IsTruncated>false</IsTruncated></ListBucketResult>")
+						w.Header().Set("Content-Type", "application/xml")
+						io.WriteString(w, list.String())
+					case objects[key] != nil:
+						sum := md5.Sum(objects[key])
+						w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+						http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(objects[key]))
+					default:
+						w.WriteHeader(http.StatusNotFound)
+					}
+				}))
+				defer server.Close()
+				endpoint = server.URL
+			} else {
+				os.Setenv("DEPLOY_TEST_S3_ACCESS_KEY", os.Getenv("DEPLOY_TEST_S3_ACCESS_KEY_ID"))
+				os.Setenv("DEPLOY_TEST_S3_SECRET_KEY", os.Getenv("DEPLOY_TEST_S3_SECRET_ACCESS_KEY"))
+			}
+			defer os.Unsetenv("DEPLOY_TEST_S3_ACCESS_KEY")
+			defer os.Unsetenv("DEPLOY_TEST_S3_SECRET_KEY")
+
+			u, err := url.Parse(endpoint)
+			Expect(err).NotTo(HaveOccurred())
+			client := &s3.Client{
+				Endpoint: u,
+				Region:   "us-east-1",
+				Bucket:   bucket,
+				Credentials: s3.Credentials{
+					AccessKey: os.Getenv("DEPLOY_TEST_S3_ACCESS_KEY"),
+					SecretKey: os.Getenv("DEPLOY_TEST_S3_SECRET_KEY"),
+				},
+				HTTPClient: http.DefaultClient,
+			}
+
+			upload := func(version string) {
+				file := filepath.Join(env.Dir, "app-"+version+".tar.gz")
+				_, err := createArchive(file, []archiveEntry{
+					{Name: "app.txt", Content: version},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				data, err := os.ReadFile(file)
+				Expect(err).NotTo(HaveOccurred())
+				err = client.Put(prefix+"app-"+version+".tar.gz", data)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Provider = "s3"
+				cfg.Source.S3.Endpoint = endpoint
+				cfg.Source.S3.Bucket = bucket
+				cfg.Source.S3.Prefix = prefix
+				cfg.Source.S3.AccessKeyEnv = "DEPLOY_TEST_S3_ACCESS_KEY"
+				cfg.Source.S3.SecretKeyEnv = "DEPLOY_TEST_S3_SECRET_KEY"
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// without a pointer object the highest version is deployed
+			upload("1.2.0")
+			upload("1.10.0")
+			upload("1.9.0")
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			content, err := os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.10.0"))
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Source).To(HaveKeyWithValue("key", prefix+"app-1.10.0.tar.gz"))
+			Expect(metadata.Revision).NotTo(BeEmpty())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("remote revision is already deployed, skipping deployment"))
+
+			// the pointer object names the artifact to deploy
+			err = client.Put(prefix+"latest", []byte("app-1.2.0.tar.gz\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			content, err = os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.2.0"))
+		})
+
+		It("should deploy the layers of an artifact in an oci registry", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-oci-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// a local registry:2 or zot is used if configured, otherwise a fake
+			// registry requiring token auth
+			registryHost := os.Getenv("DEPLOY_TEST_OCI_REGISTRY")
+			if registryHost == "" {
+				os.Setenv("DEPLOY_TEST_OCI_TOKEN", "secret")
+				defer os.Unsetenv("DEPLOY_TEST_OCI_TOKEN")
+
+				server := newTestRegistry("team/app", "deploy", "secret")
+				defer server.Close()
+				registryHost = strings.TrimPrefix(server.URL, "http://")
+			}
+
+			push := func(version string) string {
+				file := filepath.Join(env.Dir, "app-"+version+".tar.gz")
+				_, err := createArchive(file, []archiveEntry{
+					{Name: "app/app.txt", Content: version},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				data, err := os.ReadFile(file)
+				Expect(err).NotTo(HaveOccurred())
+
+				digest, err := pushArtifact("http://"+registryHost, "team/app", "stable", []ociLayer{
+					{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Data: data},
+					{MediaType: "text/plain", Data: []byte(version), Title: "VERSION"},
+					{MediaType: "application/vnd.example.docs", Data: []byte("docs"), Title: "docs.txt"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return digest
+			}
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Provider = "oci"
+				cfg.Source.OCI.Image = registryHost + "/team/app:stable"
+				cfg.Source.OCI.MediaTypes = []string{"application/vnd.oci.image.layer.v1.tar+gzip", "text/plain"}
+				cfg.Source.OCI.StripComponents = 1
+				cfg.Source.OCI.Insecure = true
+				if os.Getenv("DEPLOY_TEST_OCI_REGISTRY") == "" {
+					cfg.Source.OCI.Username = "deploy"
+					cfg.Source.OCI.TokenEnv = "DEPLOY_TEST_OCI_TOKEN"
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			firstDigest := push("1.0.0")
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			content, err := os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.0.0"))
+			Expect(filepath.Join(currentDir, "VERSION")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "docs.txt")).NotTo(BeAnExistingFile())
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Revision).To(Equal(firstDigest))
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("remote revision is already deployed, skipping deployment"))
+
+			push("1.1.0")
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			content, err = os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.1.0"))
+
+			// a digest pins the previous artifact
+			err = env.Deploy("--ref", firstDigest)
+			Expect(err).NotTo(HaveOccurred())
+			content, err = os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.0.0"))
+		})
+
+		It("should verify the signatures of oci layers before extracting them", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-oci-signature-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			server := newTestRegistry("team/app", "deploy", "secret")
+			defer server.Close()
+			os.Setenv("DEPLOY_TEST_OCI_TOKEN", "secret")
+			defer os.Unsetenv("DEPLOY_TEST_OCI_TOKEN")
+
+			keyFile := filepath.Join(env.Dir, "deploy.key")
+			pubFile := filepath.Join(env.Dir, "deploy.pub")
+			err = app.Run([]string{"deploy", "sign", "keygen", "--secret-key", keyFile, "--public-key", pubFile})
+			Expect(err).NotTo(HaveOccurred())
+			publicKey, err := os.ReadFile(pubFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			push := func(version string, signed bool) {
+				file := filepath.Join(env.Dir, "app.tar.gz")
+				_, err := createArchive(file, []archiveEntry{
+					{Name: "app.txt", Content: version},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				data, err := os.ReadFile(file)
+				Expect(err).NotTo(HaveOccurred())
+
+				layers := []ociLayer{
+					{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Data: data, Title: "app.tar.gz"},
+				}
+				if signed {
+					err = app.Run([]string{"deploy", "sign", "-k", keyFile, file})
+					Expect(err).NotTo(HaveOccurred())
+					sig, err := os.ReadFile(file + ".minisig")
+					Expect(err).NotTo(HaveOccurred())
+					layers = append(layers, ociLayer{MediaType: "application/vnd.minisign.signature", Data: sig, Title: "app.tar.gz.minisig"})
+				}
+
+				_, err = pushArtifact(server.URL, "team/app", "stable", layers)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Source.Provider = "oci"
+				cfg.Source.OCI.Image = strings.TrimPrefix(server.URL, "http://") + "/team/app:stable"
+				cfg.Source.OCI.Insecure = true
+				cfg.Source.OCI.Username = "deploy"
+				cfg.Source.OCI.TokenEnv = "DEPLOY_TEST_OCI_TOKEN"
+				cfg.Source.Signature.PublicKeys = []string{string(publicKey)}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			push("1.0.0", true)
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			content, err := os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.0.0"))
+			Expect(filepath.Join(currentDir, "app.tar.gz.minisig")).NotTo(BeAnExistingFile())
+
+			metadata, err := release.ReadMetadata(currentDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(publicKey)).To(ContainSubstring(metadata.Source["signed_by"]))
+
+			// an unsigned artifact is rejected before a release is created
+			push("1.1.0", false)
+			releases, err := os.ReadDir(filepath.Join(env.Dir, "app", "releases"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("has no signature"))
+			Expect(os.ReadDir(filepath.Join(env.Dir, "app", "releases"))).To(HaveLen(len(releases)))
+			content, err = os.ReadFile(filepath.Join(currentDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1.0.0"))
+		})
+
+		It("should run hooks non-interactively", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-hooks-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the hook would block forever if stdin was inherited from the terminal
+			err = env.CommitHook("build", "#!/bin/sh\n"+
+				"read answer\n"+
+				"echo \"ci=$CI\" > hook.out\n"+
+				"printf '\\033[31mcolored output\\033[0m\\n'\n"+
+				"[ -t 1 ] && echo 'terminal: yes' || echo 'terminal: no'\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(env.Dir, "app", "current", "hook.out")).To(BeAnExistingFile())
+			out, err := os.ReadFile(filepath.Join(env.Dir, "app", "current", "hook.out"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(out)).To(Equal("ci=true\n"))
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("colored output"))
+			Expect(log).To(ContainSubstring("terminal: no"))
+			Expect(log).NotTo(ContainSubstring("\033"))
+		})
+
+		It("should run hooks in a pseudo-terminal when configured", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-hooks-2")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Deploy.Hooks.TTY = true
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitHook("build", "#!/bin/sh\n"+
+				// tput sgr0 resets the character set with ESC ( B
+				"printf '\\033[32mcolored output\\033(B\\033[m\\n'\n"+
+				"[ -t 1 ] && echo 'terminal: yes' || echo 'terminal: no'\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current")).To(BeADirectory())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(MatchRegexp(`colored output\r?\n`))
+			Expect(log).To(ContainSubstring("terminal: yes"))
+			Expect(log).NotTo(ContainSubstring("\033"))
+		})
+
+		It("should run starlark hooks", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-hooks-3")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitContent("app.conf.tmpl", "name={{ .Vars.name }} revision={{ .Revision }}\n", 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitContent(filepath.Join(".deploy", "hooks", "build.star"), `
+deploy.log("building in " + deploy.release_dir)
+deploy.run("echo $CI > ci.out")
+code = deploy.run("exit 3", check = False)
+if code != 3:
+    fail("unexpected exit code %d" % code)
+deploy.template("app.conf.tmpl", "app.conf", vars = {"name": "api"})
+`, 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir := filepath.Join(env.Dir, "app", "current")
+			revision, err := os.ReadFile(filepath.Join(currentDir, "REVISION"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(currentDir, "ci.out")).To(BeAnExistingFile())
+			Expect(filepath.Join(currentDir, "app.conf")).To(BeAnExistingFile())
+
+			conf, err := os.ReadFile(filepath.Join(currentDir, "app.conf"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(conf)).To(Equal("name=api revision=" + string(revision) + "\n"))
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("building in "))
+		})
+
+		It("should verify the release with health probes", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-probes-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Probe") != "deploy" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				_, _ = w.Write([]byte(`{"status":"ok"}`))
+			}))
+			defer server.Close()
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Verify.Probes = []config.ProbeConfig{
+					{Type: "http", URL: server.URL, Body: `"status":"ok"`, Headers: map[string]string{"X-Probe": "deploy"}},
+					{Type: "tcp", Address: server.Listener.Addr().String()},
+					{Type: "command", Command: "test -f test1.txt"},
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current", "test1.txt")).To(BeAnExistingFile())
+
+			// the second release fails the command probe and is rolled back
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Verify.Probes = []config.ProbeConfig{
+					{Name: "missing-file", Type: "command", Command: "test -f missing.txt", Retries: 1, Interval: "10ms"},
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test2.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current", "test1.txt")).To(BeAnExistingFile())
+			Expect(filepath.Join(env.Dir, "app", "current", "test2.txt")).NotTo(BeAnExistingFile())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("probe missing-file: failed after 2 attempt(s)"))
+
+			// a probe without attempts never passes
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Verify.Probes = []config.ProbeConfig{
+					{Name: "no-attempts", Type: "command", Command: "true", Retries: -1},
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "current", "test2.txt")).NotTo(BeAnExistingFile())
+
+			log, err = env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("invalid retries: -1, must not be negative"))
+		})
+
+		It("should roll back a release that fails during the bake period", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-bake-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Verify.Bake = "300ms"
+				cfg.Verify.BakeInterval = "100ms"
+				cfg.Verify.BakeFailures = 2
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitHook("watch", "#!/bin/sh\nexit 0\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			metadata, err := release.ReadMetadata(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Status).To(Equal(release.StatusGood))
+			Expect(metadata.VerifiedAt).NotTo(BeNil())
+			goodRevision := metadata.Revision
+
+			err = env.CommitHook("watch", "#!/bin/sh\necho 'queue is stuck'\nexit 1\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			metadata, err = release.ReadMetadata(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Revision).To(Equal(goodRevision))
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("bake check failed (2/2)"))
+			Expect(log).To(ContainSubstring("release failed during the bake period"))
+		})
+
+		It("should run reload actions after activation and on rollback", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-reload-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Deploy.Reload = []config.ReloadConfig{
+					{Type: "touch", Path: "shared/restart.txt"},
+					{Type: "command", Command: "basename \"$PWD\" >> ../../shared/reloads.txt"},
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(env.Dir, "app", "shared", "restart.txt")).To(BeAnExistingFile())
+
+			firstRelease, err := os.Readlink(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitHook("verify", "#!/bin/sh\nexit 1\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			currentRelease, err := os.Readlink(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(currentRelease).To(Equal(firstRelease))
+
+			reloads, err := os.ReadFile(filepath.Join(env.Dir, "app", "shared", "reloads.txt"))
+			Expect(err).NotTo(HaveOccurred())
+
+			lines := strings.Split(strings.TrimSpace(string(reloads)), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(lines[0]).To(Equal(filepath.Base(firstRelease)))
+			Expect(lines[1]).NotTo(Equal(filepath.Base(firstRelease)))
+			Expect(lines[2]).To(Equal(filepath.Base(firstRelease)))
+		})
+
+		It("should kill reload commands with their children on timeout", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-reload-2")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			// the sleep keeps the output open after the shell is killed
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Deploy.Reload = []config.ReloadConfig{
+					{Type: "command", Command: "sleep 4; echo done", Timeout: "500ms"},
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			start := time.Now()
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 3*time.Second))
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("reload command sleep 4; echo done: failed: signal: killed"))
+		})
+
+		It("should drain the host around activation", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-drain-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			drainFile := filepath.Join(env.Dir, "app", "shared", "drained")
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Deploy.Drain = config.DrainConfig{Type: "file", Path: drainFile}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// record whether the host was drained while the release was verified
+			err = env.CommitHook("verify", "#!/bin/sh\ntest -f \""+drainFile+"\" && echo drained >> ../../shared/verify.txt\nexit 0\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(drainFile).NotTo(BeAnExistingFile())
+
+			verified, err := os.ReadFile(filepath.Join(env.Dir, "app", "shared", "verify.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.TrimSpace(string(verified))).To(Equal("drained"))
+
+			err = env.CommitHook("verify", "#!/bin/sh\nexit 1\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(drainFile).NotTo(BeAnExistingFile())
+
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Count(log, "undraining host")).To(Equal(2))
+		})
+
+		It("should enable maintenance mode during the deployment", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-maintenance-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			marker := filepath.Join(env.Dir, "app", "shared", "down")
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Deploy.Maintenance = config.MaintenanceConfig{
+					Marker: "shared/down",
+					From:   "deploy",
+					Until:  "verify",
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitHook("deploy", "#!/bin/sh\ntest -f ../../shared/down && echo down >> ../../shared/deploy.txt\nexit 0\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(marker).NotTo(BeAnExistingFile())
+
+			deployed, err := os.ReadFile(filepath.Join(env.Dir, "app", "shared", "deploy.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.TrimSpace(string(deployed))).To(Equal("down"))
+
+			// a failure inside the window still disables maintenance mode
+			err = env.CommitHook("post_deploy", "#!/bin/sh\nexit 1\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(marker).NotTo(BeAnExistingFile())
+
+			configFile := filepath.Join(env.Dir, "app", "config.toml")
 
-	workingDir, err = os.Getwd()
-	Expect(err).NotTo(HaveOccurred())
+			err = app.Run([]string{"deploy", "maintenance", "on", "-f", configFile})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(marker).To(BeAnExistingFile())
 
-	workingDir = filepath.Join(workingDir, "testdata")
-	Expect(err).NotTo(HaveOccurred())
+			// maintenance mode enabled manually outlives the deployment
+			err = env.CommitHook("post_deploy", "#!/bin/sh\nexit 0\n")
+			Expect(err).NotTo(HaveOccurred())
 
-	err = os.RemoveAll(workingDir)
-	Expect(err).NotTo(HaveOccurred())
-})
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(marker).To(BeAnExistingFile())
 
-var _ = Describe("Deploy", func() {
-	Context("init command", func() {
-		It("should create a new application deployment structure", func() {
-			// create a new test environment
-			env, err := NewTestEnv(workingDir, "init-test-1")
+			log, err := env.ReadLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(ContainSubstring("maintenance mode is already enabled, leaving it enabled"))
+
+			err = app.Run([]string{"deploy", "maintenance", "off", "-f", configFile})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(marker).NotTo(BeAnExistingFile())
+
+			// a running deployment keeps maintenance mode to itself
+			lockFile := filepath.Join(env.Dir, "app", "deploy.lock")
+			err = os.WriteFile(lockFile, []byte{}, 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = app.Run([]string{"deploy", "maintenance", "on", "-f", configFile})
+			Expect(err).To(MatchError(ContainSubstring("deployment already in progress")))
+			Expect(marker).NotTo(BeAnExistingFile())
+			Expect(lockFile).To(BeAnExistingFile())
+		})
+
+		It("should remove the maintenance page from the release it was copied into", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-maintenance-2")
 			Expect(err).NotTo(HaveOccurred())
-			Expect(env.Dir).To(BeADirectory())
 
-			// change working directory to the test environment
 			err = os.Chdir(env.Dir)
 			Expect(err).NotTo(HaveOccurred())
 
-			// run the init command
-			err = app.Run([]string{"deploy", "init", "-n", "app"})
+			_, err = env.InitApp()
 			Expect(err).NotTo(HaveOccurred())
 
-			// check that the application structure was created
-			Expect(filepath.Join(env.Dir, "app")).To(BeADirectory())
-			Expect(filepath.Join(env.Dir, "app", "releases")).To(BeADirectory())
-			Expect(filepath.Join(env.Dir, "app", "shared")).To(BeADirectory())
-			Expect(filepath.Join(env.Dir, "app", "logs")).To(BeADirectory())
-			Expect(filepath.Join(env.Dir, "app", "config.toml")).To(BeAnExistingFile())
+			err = env.ConfigureApp(nil)
+			Expect(err).NotTo(HaveOccurred())
 
-			// check that the config file was created with the correct content
-			generatedConfig, err := config.Load(filepath.Join(env.Dir, "app", "config.toml"))
+			err = env.CommitFile("test1.txt")
 			Expect(err).NotTo(HaveOccurred())
 
-			defaultConfig := config.Default()
-			Expect(generatedConfig).To(Equal(defaultConfig))
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			previousRelease, err := filepath.EvalSymlinks(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.WriteFile(filepath.Join(env.Dir, "app", "shared", "maintenance.html"), []byte("down"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the window spans the switch of current to the new release
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Deploy.Maintenance = config.MaintenanceConfig{
+					Page:    "shared/maintenance.html",
+					WebRoot: "current/public",
+					From:    "deploy",
+					Until:   "verify",
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitHook("deploy", "#!/bin/sh\ntest -f ../../current/public/maintenance.html && echo down >> ../../shared/deploy.txt\nexit 0\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			deployed, err := os.ReadFile(filepath.Join(env.Dir, "app", "shared", "deploy.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.TrimSpace(string(deployed))).To(Equal("down"))
+
+			currentRelease, err := filepath.EvalSymlinks(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(currentRelease).NotTo(Equal(previousRelease))
+			Expect(filepath.Join(previousRelease, "public", "maintenance.html")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(currentRelease, "public", "maintenance.html")).NotTo(BeAnExistingFile())
+
+			configFile := filepath.Join(env.Dir, "app", "config.toml")
+
+			err = app.Run([]string{"deploy", "maintenance", "on", "-f", configFile})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentRelease, "public", "maintenance.html")).To(BeAnExistingFile())
+
+			err = app.Run([]string{"deploy", "maintenance", "off", "-f", configFile})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(currentRelease, "public", "maintenance.html")).NotTo(BeAnExistingFile())
 		})
-	})
 
-	Context("deploy command", func() {
-		It("should successfully deploy", func() {
-			// create a new test environment
-			env, err := NewTestEnv(workingDir, "deploy-test-1")
+		It("should supervise the processes of the current release", func() {
+			env, err := NewTestEnv(workingDir, "deploy-test-supervise-1")
 			Expect(err).NotTo(HaveOccurred())
-			Expect(env.Dir).To(BeADirectory())
 
-			// change working directory to the test environment
 			err = os.Chdir(env.Dir)
 			Expect(err).NotTo(HaveOccurred())
 
-			// init the app
 			_, err = env.InitApp()
 			Expect(err).NotTo(HaveOccurred())
 
-			// commit a file
+			err = env.ConfigureApp(nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.CommitContent("Procfile", "# workers\nworker: echo \"started $(basename $PWD)\"; exec sleep 60\n", 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			firstRelease, err := os.Readlink(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			supervised := make(chan error, 1)
+			go func() {
+				supervised <- app.RunContext(ctx, []string{"deploy", "supervise", "-f", filepath.Join(env.Dir, "app", "config.toml")})
+			}()
+
+			workerLog := func() string {
+				content, _ := os.ReadFile(filepath.Join(env.Dir, "app", "logs", "worker.log"))
+				return string(content)
+			}
+			Eventually(workerLog, 5*time.Second).Should(ContainSubstring("started " + filepath.Base(firstRelease)))
+
 			err = env.CommitFile("test1.txt")
 			Expect(err).NotTo(HaveOccurred())
 
-			// start the deployment
-			err = app.Run([]string{"deploy", "start", "-f", filepath.Join(env.Dir, "app", "config.toml")})
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			secondRelease, err := os.Readlink(filepath.Join(env.Dir, "app", "current"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secondRelease).NotTo(Equal(firstRelease))
+
+			Eventually(workerLog, 5*time.Second).Should(ContainSubstring("started " + filepath.Base(secondRelease)))
+
+			cancel()
+			Eventually(supervised, 5*time.Second).Should(Receive(BeNil()))
+		})
+
+		It("should switch traffic between blue and green slots", func() {
+			if _, err := exec.LookPath("python3"); err != nil {
+				Skip("python3 is required to serve the test app")
+			}
+
+			env, err := NewTestEnv(workingDir, "deploy-test-bluegreen-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Chdir(env.Dir)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = env.InitApp()
+			Expect(err).NotTo(HaveOccurred())
+
+			ports, err := freePorts(3)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.ConfigureApp(func(cfg *config.Config) {
+				cfg.Deploy.BlueGreen = config.BlueGreenConfig{
+					Enabled: true,
+					Command: "exec python3 -m http.server \"$PORT\" --bind 127.0.0.1",
+					Ports:   ports[:2],
+					Listen:  fmt.Sprintf("127.0.0.1:%d", ports[2]),
+				}
+				cfg.Verify.Probes = []config.ProbeConfig{
+					{Type: "http", URL: "http://127.0.0.1:${PORT}/REVISION", Retries: 20, Interval: "100ms"},
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = bluegreen.Stop(filepath.Join(env.Dir, "app"), bluegreen.SlotBlue, time.Second)
+				_ = bluegreen.Stop(filepath.Join(env.Dir, "app"), bluegreen.SlotGreen, time.Second)
+			}()
+
+			err = env.CommitFile("test1.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			state, err := bluegreen.ReadState(filepath.Join(env.Dir, "app"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Active).To(Equal(bluegreen.SlotBlue))
+			Expect(httpGet(fmt.Sprintf("http://127.0.0.1:%d/test1.txt", ports[0]))).To(Equal(http.StatusOK))
+
+			err = env.CommitFile("test2.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = env.Deploy()
+			Expect(err).NotTo(HaveOccurred())
+
+			state, err = bluegreen.ReadState(filepath.Join(env.Dir, "app"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Active).To(Equal(bluegreen.SlotGreen))
+			Expect(httpGet(fmt.Sprintf("http://127.0.0.1:%d/test2.txt", ports[1]))).To(Equal(http.StatusOK))
+
+			// the blue slot was drained and stopped
+			Expect(httpGet(fmt.Sprintf("http://127.0.0.1:%d/test1.txt", ports[0]))).To(Equal(0))
+
+			// a pidfile of a process that doesn't belong to the slot is removed
+			// without stopping the process
+			other := exec.Command("sleep", "30")
+			other.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			err = other.Start()
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = other.Process.Kill(); _ = other.Wait() }()
+
+			pidFile := filepath.Join(env.Dir, "app", "blue.pid")
+			err = os.WriteFile(pidFile, []byte(strconv.Itoa(other.Process.Pid)), 0644)
 			Expect(err).NotTo(HaveOccurred())
+
+			err = bluegreen.Stop(filepath.Join(env.Dir, "app"), bluegreen.SlotBlue, time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pidFile).NotTo(BeAnExistingFile())
+			Expect(other.Process.Signal(syscall.Signal(0))).To(Succeed())
+
+			err = os.WriteFile(pidFile, []byte("1"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = bluegreen.Stop(filepath.Join(env.Dir, "app"), bluegreen.SlotBlue, time.Second)
+			Expect(err).To(MatchError(ContainSubstring("invalid pid in pidfile: 1")))
+
+			err = os.Remove(pidFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			proxied := make(chan error, 1)
+			go func() {
+				proxied <- app.RunContext(ctx, []string{"deploy", "proxy", "-f", filepath.Join(env.Dir, "app", "config.toml")})
+			}()
+
+			Eventually(func() int {
+				return httpGet(fmt.Sprintf("http://127.0.0.1:%d/test2.txt", ports[2]))
+			}, 5*time.Second).Should(Equal(http.StatusOK))
+
+			cancel()
+			Eventually(proxied, 5*time.Second).Should(Receive(BeNil()))
 		})
 
 		// force
@@ -177,6 +2269,85 @@ func (t testEnv) CommitFile(filename string) error {
 	return nil
 }
 
+// ConfigureApp points the app's config at the test repository, disables
+// jitter and applies the given changes.
+func (t testEnv) ConfigureApp(fn func(cfg *config.Config)) error {
+	configPath := filepath.Join(t.Dir, "app", "config.toml")
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	cfg.Source.Git.Repo = filepath.Join(t.Dir, "repo")
+	cfg.Deploy.Jitter.Min = 0
+	cfg.Deploy.Jitter.Max = 0
+
+	if fn != nil {
+		fn(cfg)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(cfg); err != nil {
+		return err
+	}
+
+	return os.WriteFile(configPath, buf.Bytes(), 0644)
+}
+
+// CommitHook adds an executable hook to the test repository and commits it.
+func (t testEnv) CommitHook(name string, script string) error {
+	return t.CommitContent(filepath.Join(".deploy", "hooks", name), script, 0755)
+}
+
+// CommitContent writes a file with the given content to the test repository
+// and commits it.
+func (t testEnv) CommitContent(path string, content string, perm os.FileMode) error {
+	repoDir := filepath.Join(t.Dir, "repo")
+
+	err := os.MkdirAll(filepath.Dir(filepath.Join(repoDir, path)), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(repoDir, path), []byte(content), perm)
+	if err != nil {
+		return err
+	}
+
+	err = runGitCommand(repoDir, "add", path)
+	if err != nil {
+		return err
+	}
+
+	return runGitCommand(repoDir, "commit", "-m", "add "+path)
+}
+
+// Deploy runs the start command against the test app.
+func (t testEnv) Deploy(args ...string) error {
+	args = append([]string{"deploy", "start", "-f", filepath.Join(t.Dir, "app", "config.toml")}, args...)
+	return app.Run(args)
+}
+
+// ReadLog returns the contents of the app's log files.
+func (t testEnv) ReadLog() (string, error) {
+	files, err := filepath.Glob(filepath.Join(t.Dir, "app", "logs", "*.log"))
+	if err != nil {
+		return "", err
+	}
+
+	var log strings.Builder
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		log.Write(content)
+	}
+
+	return log.String(), nil
+}
+
 func (t testEnv) CreateHooks() error {
 	hookLogFile := filepath.Join(t.Dir, "repo", ".deploy", "hooks.log")
 
@@ -209,6 +2380,279 @@ func (t testEnv) CreateHooks() error {
 	return nil
 }
 
+// freePorts returns ports that are free to listen on.
+func freePorts(n int) ([]int, error) {
+	var ports []int
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	return ports, nil
+}
+
+// archiveEntry is a file, or a symlink if Link is set, of a test archive.
+type archiveEntry struct {
+	Name    string
+	Content string
+	Link    string
+	Mode    os.FileMode
+}
+
+// createArchive writes a tar.gz, tar.zst or zip archive, by the extension of
+// the path, and returns its sha256.
+func createArchive(path string, entries []archiveEntry) (string, error) {
+	var buf bytes.Buffer
+
+	if strings.HasSuffix(path, ".zip") {
+		zw := zip.NewWriter(&buf)
+		for _, entry := range entries {
+			header := &zip.FileHeader{Name: entry.Name, Method: zip.Deflate}
+			content := entry.Content
+			switch {
+			case entry.Link != "":
+				header.SetMode(os.ModeSymlink | 0777)
+				content = entry.Link
+			case entry.Mode != 0:
+				header.SetMode(entry.Mode)
+			default:
+				header.SetMode(0644)
+			}
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return "", err
+			}
+			if _, err := w.Write([]byte(content)); err != nil {
+				return "", err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return "", err
+		}
+	} else {
+		var compressed io.WriteCloser
+		if strings.HasSuffix(path, ".zst") {
+			zw, err := zstd.NewWriter(&buf)
+			if err != nil {
+				return "", err
+			}
+			compressed = zw
+		} else {
+			compressed = gzip.NewWriter(&buf)
+		}
+
+		tw := tar.NewWriter(compressed)
+		for _, entry := range entries {
+			header := &tar.Header{Name: entry.Name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.Content))}
+			if entry.Mode != 0 {
+				header.Mode = int64(entry.Mode)
+			}
+			if entry.Link != "" {
+				header.Typeflag = tar.TypeSymlink
+				header.Linkname = entry.Link
+				header.Size = 0
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return "", err
+			}
+			if entry.Link == "" {
+				if _, err := tw.Write([]byte(entry.Content)); err != nil {
+					return "", err
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return "", err
+		}
+		if err := compressed.Close(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newTestRegistry starts a fake OCI registry for the repository. Pulls
+// require a bearer token of its token service, which requires basic auth with
+// the username and password, pushes are accepted without auth.
+func newTestRegistry(repository, username, password string) *httptest.Server {
+	blobs := map[string][]byte{}
+	manifests := map[string][]byte{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := "repository:" + repository + ":pull"
+		if r.URL.Path == "/token" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != username || pass != password || r.URL.Query().Get("scope") != scope {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			io.WriteString(w, `{"token": "pull-token"}`)
+			return
+		}
+
+		path, ok := strings.CutPrefix(r.URL.Path, "/v2/"+repository+"/")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPost && path == "blobs/uploads/":
+			w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/1")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case r.Method == http.MethodPut && strings.HasPrefix(path, "blobs/uploads/"):
+			data, _ := io.ReadAll(r.Body)
+			blobs[r.URL.Query().Get("digest")] = data
+			w.WriteHeader(http.StatusCreated)
+			return
+		case r.Method == http.MethodPut && strings.HasPrefix(path, "manifests/"):
+			data, _ := io.ReadAll(r.Body)
+			sum := sha256.Sum256(data)
+			digest := "sha256:" + hex.EncodeToString(sum[:])
+			manifests[strings.TrimPrefix(path, "manifests/")] = data
+			manifests[digest] = data
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer pull-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope=%q`, server.URL, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var data []byte
+		if ref, ok := strings.CutPrefix(path, "manifests/"); ok {
+			data = manifests[ref]
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		} else {
+			data = blobs[strings.TrimPrefix(path, "blobs/")]
+		}
+		if data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}))
+
+	return server
+}
+
+// ociLayer is a layer of a test artifact, a file pushed by oras if Title is
+// set.
+type ociLayer struct {
+	MediaType string
+	Data      []byte
+	Title     string
+}
+
+// pushArtifact pushes the layers as an OCI artifact tagged with the tag and
+// returns the digest of its manifest.
+func pushArtifact(registry, repository, tag string, layers []ociLayer) (string, error) {
+	pushBlob := func(data []byte) (string, error) {
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+
+		resp, err := http.Post(registry+"/v2/"+repository+"/blobs/uploads/", "", nil)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return "", fmt.Errorf("failed to start upload: %d", resp.StatusCode)
+		}
+
+		location, err := resp.Location()
+		if err != nil {
+			return "", err
+		}
+		query := location.Query()
+		query.Set("digest", digest)
+		location.RawQuery = query.Encode()
+
+		req, err := http.NewRequest(http.MethodPut, location.String(), bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return "", fmt.Errorf("failed to upload blob: %d", resp.StatusCode)
+		}
+
+		return digest, nil
+	}
+
+	configDigest, err := pushBlob([]byte("{}"))
+	if err != nil {
+		return "", err
+	}
+
+	var descriptors []string
+	for _, layer := range layers {
+		digest, err := pushBlob(layer.Data)
+		if err != nil {
+			return "", err
+		}
+		annotations := ""
+		if layer.Title != "" {
+			annotations = fmt.Sprintf(`, "annotations": {"org.opencontainers.image.title": %q}`, layer.Title)
+		}
+		descriptors = append(descriptors, fmt.Sprintf(`{"mediaType": %q, "digest": %q, "size": %d%s}`, layer.MediaType, digest, len(layer.Data), annotations))
+	}
+
+	manifest := fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": %q, "size": 2}, "layers": [%s]}`,
+		configDigest, strings.Join(descriptors, ", "))
+
+	req, err := http.NewRequest(http.MethodPut, registry+"/v2/"+repository+"/manifests/"+tag, strings.NewReader(manifest))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("failed to push manifest: %d", resp.StatusCode)
+	}
+
+	sum := sha256.Sum256([]byte(manifest))
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// httpGet returns the status code of a GET request, or 0 if it failed.
+func httpGet(url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode
+}
+
 func runGitCommand(dir string, args ...string) error {
 	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
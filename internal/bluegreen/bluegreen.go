@@ -0,0 +1,245 @@
+package bluegreen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+)
+
+type Slot string
+
+const (
+	SlotBlue  Slot = "blue"
+	SlotGreen Slot = "green"
+)
+
+const stateFileName = "bluegreen.json"
+
+// State records which slot receives traffic and which release each slot runs.
+type State struct {
+	Active Slot                `json:"active,omitempty"`
+	Slots  map[Slot]*SlotState `json:"slots"`
+}
+
+type SlotState struct {
+	Port    int    `json:"port"`
+	Release string `json:"release"`
+}
+
+// Idle returns the slot that doesn't receive traffic. It's the blue slot if
+// no slot is active yet.
+func (s *State) Idle() Slot {
+	if s.Active == SlotBlue {
+		return SlotGreen
+	}
+	return SlotBlue
+}
+
+// Port returns the port configured for the slot.
+func Port(cfg config.BlueGreenConfig, slot Slot) (int, error) {
+	if len(cfg.Ports) != 2 {
+		return 0, fmt.Errorf("blue/green deployments require exactly two ports, got %d", len(cfg.Ports))
+	}
+
+	if slot == SlotBlue {
+		return cfg.Ports[0], nil
+	}
+	return cfg.Ports[1], nil
+}
+
+func ReadState(appDir string) (*State, error) {
+	state := &State{Slots: make(map[Slot]*SlotState)}
+
+	data, err := os.ReadFile(filepath.Join(appDir, stateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read blue/green state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse blue/green state: %w", err)
+	}
+	if state.Slots == nil {
+		state.Slots = make(map[Slot]*SlotState)
+	}
+
+	return state, nil
+}
+
+func WriteState(appDir string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal blue/green state: %w", err)
+	}
+
+	// write and rename, so the proxy never reads a partial file
+	path := filepath.Join(appDir, stateFileName)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write blue/green state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write blue/green state: %w", err)
+	}
+
+	return nil
+}
+
+// Start starts the configured command from the release directory on the
+// slot's port. The process is detached from the deploy process, so it keeps
+// running after the deployment finished. A process already running on the
+// slot is stopped first.
+func Start(appDir string, cfg config.BlueGreenConfig, slot Slot, releaseDir string) error {
+	if cfg.Command == "" {
+		return fmt.Errorf("blue/green deployments require a command")
+	}
+
+	port, err := Port(cfg, slot)
+	if err != nil {
+		return err
+	}
+
+	if err := Stop(appDir, slot, time.Second); err != nil {
+		return err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(appDir, "logs", string(slot)+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command("/bin/sh", "-c", cfg.Command)
+	cmd.Dir = releaseDir
+	cmd.Env = append(os.Environ(),
+		"PORT="+strconv.Itoa(port),
+		"DEPLOY_SLOT="+string(slot),
+	)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// a new session, so the process outlives the deploy process and can be
+	// stopped together with its children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s slot: %w", slot, err)
+	}
+	// reap the process if it exits while we are still running
+	go func() { _ = cmd.Wait() }()
+
+	if err := os.WriteFile(pidFile(appDir, slot), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		return fmt.Errorf("failed to write pidfile: %w", err)
+	}
+
+	state, err := ReadState(appDir)
+	if err != nil {
+		return err
+	}
+	state.Slots[slot] = &SlotState{Port: port, Release: releaseDir}
+
+	return WriteState(appDir, state)
+}
+
+// Stop sends SIGTERM to the process of the slot and SIGKILL if it is still
+// running after the grace period. Stopping a slot that isn't running is a
+// no-op.
+func Stop(appDir string, slot Slot, gracePeriod time.Duration) error {
+	data, err := os.ReadFile(pidFile(appDir, slot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read pidfile: %w", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid pid in pidfile: %w", err)
+	}
+
+	// the process is the leader of its session and process group
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to stop %s slot: %w", slot, err)
+	}
+
+	deadline := time.Now().Add(gracePeriod)
+	for running(pid) {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(-pid, syscall.SIGKILL)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return os.Remove(pidFile(appDir, slot))
+}
+
+// Switch routes the traffic to the slot. The built-in proxy picks up the
+// change from the state file, an upstream file is rewritten and reloaded.
+func Switch(appDir string, cfg config.BlueGreenConfig, slot Slot) error {
+	port, err := Port(cfg, slot)
+	if err != nil {
+		return err
+	}
+
+	state, err := ReadState(appDir)
+	if err != nil {
+		return err
+	}
+	state.Active = slot
+	if err := WriteState(appDir, state); err != nil {
+		return err
+	}
+
+	if cfg.UpstreamFile == "" {
+		return nil
+	}
+
+	name := cfg.UpstreamName
+	if name == "" {
+		name = "deploy"
+	}
+
+	upstream := fmt.Sprintf("upstream %s {\n    server 127.0.0.1:%d;\n}\n", name, port)
+	if err := os.WriteFile(cfg.UpstreamFile, []byte(upstream), 0644); err != nil {
+		return fmt.Errorf("failed to write upstream file: %w", err)
+	}
+
+	if cfg.ReloadCommand != "" {
+		output, err := exec.Command("/bin/sh", "-c", cfg.ReloadCommand).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to reload upstream: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	return nil
+}
+
+// SwitchDelay returns how long a switch takes to reach the traffic. The
+// built-in proxy picks up the state file on its next poll, so the previous
+// slot has to keep serving until then.
+func SwitchDelay(cfg config.BlueGreenConfig) time.Duration {
+	if cfg.Listen == "" {
+		return 0
+	}
+	return 2 * statePollInterval
+}
+
+func pidFile(appDir string, slot Slot) string {
+	return filepath.Join(appDir, string(slot)+".pid")
+}
+
+func running(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,103 @@
+package bluegreen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/logger"
+)
+
+const statePollInterval = 500 * time.Millisecond
+
+// Proxy is a reverse proxy sending all traffic to the active slot. It follows
+// the state file, so a switch takes effect without restarting the proxy.
+type Proxy struct {
+	appDir string
+	logger *logger.Logger
+	target atomic.Pointer[url.URL]
+}
+
+func NewProxy(appDir string, logger *logger.Logger) *Proxy {
+	return &Proxy{
+		appDir: appDir,
+		logger: logger,
+	}
+}
+
+// ListenAndServe serves the proxy on the address until the context is
+// cancelled.
+func (p *Proxy) ListenAndServe(ctx context.Context, addr string) error {
+	p.refresh()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(p.target.Load())
+			r.SetXForwarded()
+			r.Out.Host = r.In.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logger.Printf("proxy error: %s", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	server := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p.target.Load() == nil {
+				http.Error(w, "no active slot", http.StatusServiceUnavailable)
+				return
+			}
+			proxy.ServeHTTP(w, r)
+		}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(statePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				_ = server.Shutdown(shutdownCtx)
+				return
+			case <-ticker.C:
+				p.refresh()
+			}
+		}
+	}()
+
+	p.logger.Printf("proxy listening on %s", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve proxy: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Proxy) refresh() {
+	state, err := ReadState(p.appDir)
+	if err != nil {
+		p.logger.Printf("failed to refresh proxy target: %s", err)
+		return
+	}
+
+	slot, ok := state.Slots[state.Active]
+	if !ok {
+		return
+	}
+
+	target := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", slot.Port)}
+	if current := p.target.Load(); current == nil || current.Host != target.Host {
+		p.logger.Printf("routing traffic to the %s slot on port %d", state.Active, slot.Port)
+		p.target.Store(target)
+	}
+}
@@ -10,22 +10,108 @@ import (
 type Config struct {
 	Source SourceConfig `toml:"source"`
 	Deploy DeployConfig `toml:"deploy"`
+	Verify VerifyConfig `toml:"verify"`
+
+	Processes map[string]string `toml:"processes,omitempty"`
+	Supervise SuperviseConfig   `toml:"supervise"`
 }
 
 type SourceConfig struct {
-	Provider string    `toml:"provider"`
-	Git      GitConfig `toml:"git,omitempty"`
+	Provider string        `toml:"provider"`
+	Git      GitConfig     `toml:"git,omitempty"`
+	Bundle   BundleConfig  `toml:"bundle,omitempty"`
+	Dir      DirConfig     `toml:"dir,omitempty"`
+	Archive  ArchiveConfig `toml:"archive,omitempty"`
+	S3       S3Config      `toml:"s3,omitempty"`
+	OCI      OCIConfig     `toml:"oci,omitempty"`
+
+	Signature SignatureConfig `toml:"signature,omitempty"`
 }
 
 type GitConfig struct {
-	Repo   string `toml:"repo"`
-	Branch string `toml:"branch"`
+	Repo         string        `toml:"repo"`
+	Branch       string        `toml:"branch"`
+	Backend      string        `toml:"backend,omitempty"`
+	Mirrors      []string      `toml:"mirrors,omitempty"`
+	RetryBackoff string        `toml:"retry_backoff,omitempty"`
+	Cache        string        `toml:"cache,omitempty"`
+	Tags         string        `toml:"tags,omitempty"`
+	Prerelease   bool          `toml:"prerelease,omitempty"`
+	Path         string        `toml:"path,omitempty"`
+	WatchPaths   []string      `toml:"watch_paths,omitempty"`
+	Submodules   bool          `toml:"submodules,omitempty"`
+	LFS          bool          `toml:"lfs,omitempty"`
+	Auth         GitAuthConfig `toml:"auth"`
+}
+
+type GitAuthConfig struct {
+	SSHKey           string `toml:"ssh_key,omitempty"`
+	KnownHosts       string `toml:"known_hosts,omitempty"`
+	HostKey          string `toml:"host_key,omitempty"`
+	Username         string `toml:"username,omitempty"`
+	TokenEnv         string `toml:"token_env,omitempty"`
+	TokenFile        string `toml:"token_file,omitempty"`
+	CredentialHelper string `toml:"credential_helper,omitempty"`
+}
+
+type BundleConfig struct {
+	Inbox   string `toml:"inbox"`
+	Branch  string `toml:"branch,omitempty"`
+	Archive string `toml:"archive,omitempty"`
+}
+
+type DirConfig struct {
+	Path       string `toml:"path"`
+	IgnoreFile string `toml:"ignore_file,omitempty"`
+}
+
+type ArchiveConfig struct {
+	Manifest        string            `toml:"manifest"`
+	Format          string            `toml:"format,omitempty"`
+	StripComponents int               `toml:"strip_components,omitempty"`
+	Headers         map[string]string `toml:"headers,omitempty"`
+	Timeout         string            `toml:"timeout,omitempty"`
+}
+
+type S3Config struct {
+	Endpoint        string `toml:"endpoint,omitempty"`
+	Region          string `toml:"region,omitempty"`
+	Bucket          string `toml:"bucket"`
+	Prefix          string `toml:"prefix,omitempty"`
+	Latest          string `toml:"latest,omitempty"`
+	Format          string `toml:"format,omitempty"`
+	StripComponents int    `toml:"strip_components,omitempty"`
+	AccessKeyEnv    string `toml:"access_key_env,omitempty"`
+	SecretKeyEnv    string `toml:"secret_key_env,omitempty"`
+	CredentialsFile string `toml:"credentials_file,omitempty"`
+	Profile         string `toml:"profile,omitempty"`
+	VirtualHosted   bool   `toml:"virtual_hosted,omitempty"`
+	Timeout         string `toml:"timeout,omitempty"`
+}
+
+type OCIConfig struct {
+	Image           string   `toml:"image"`
+	MediaTypes      []string `toml:"media_types,omitempty"`
+	StripComponents int      `toml:"strip_components,omitempty"`
+	Username        string   `toml:"username,omitempty"`
+	TokenEnv        string   `toml:"token_env,omitempty"`
+	Insecure        bool     `toml:"insecure,omitempty"`
+	Timeout         string   `toml:"timeout,omitempty"`
+}
+
+type SignatureConfig struct {
+	PublicKeys []string `toml:"public_keys,omitempty"`
 }
 
 type DeployConfig struct {
-	KeepReleases int          `toml:"keep_releases"`
-	Jitter       JitterConfig `toml:"jitter"`
-	Shared       SharedConfig `toml:"shared"`
+	KeepReleases int               `toml:"keep_releases"`
+	Jitter       JitterConfig      `toml:"jitter"`
+	Shared       SharedConfig      `toml:"shared"`
+	Hooks        HooksConfig       `toml:"hooks"`
+	Reload       []ReloadConfig    `toml:"reload,omitempty"`
+	BlueGreen    BlueGreenConfig   `toml:"bluegreen"`
+	Drain        DrainConfig       `toml:"drain"`
+	Maintenance  MaintenanceConfig `toml:"maintenance"`
 }
 
 type JitterConfig struct {
@@ -33,11 +119,114 @@ type JitterConfig struct {
 	Max int `toml:"max"`
 }
 
+type ReloadConfig struct {
+	Name string `toml:"name,omitempty"`
+	Type string `toml:"type"`
+
+	// signal
+	PIDFile string `toml:"pidfile,omitempty"`
+	Signal  string `toml:"signal,omitempty"`
+
+	// command
+	Command string `toml:"command,omitempty"`
+
+	// http
+	URL    string `toml:"url,omitempty"`
+	Method string `toml:"method,omitempty"`
+
+	// touch
+	Path string `toml:"path,omitempty"`
+
+	Timeout string `toml:"timeout,omitempty"`
+}
+
+type BlueGreenConfig struct {
+	Enabled     bool   `toml:"enabled"`
+	Command     string `toml:"command,omitempty"`
+	Ports       []int  `toml:"ports,omitempty"`
+	Drain       string `toml:"drain,omitempty"`
+	GracePeriod string `toml:"grace_period,omitempty"`
+
+	// built-in proxy
+	Listen string `toml:"listen,omitempty"`
+
+	// nginx (or any other) upstream include
+	UpstreamFile  string `toml:"upstream_file,omitempty"`
+	UpstreamName  string `toml:"upstream_name,omitempty"`
+	ReloadCommand string `toml:"reload_command,omitempty"`
+}
+
+type DrainConfig struct {
+	Type string `toml:"type,omitempty"`
+	Wait string `toml:"wait,omitempty"`
+
+	// haproxy
+	Socket  string `toml:"socket,omitempty"`
+	Backend string `toml:"backend,omitempty"`
+	Server  string `toml:"server,omitempty"`
+
+	// file
+	Path string `toml:"path,omitempty"`
+
+	// command
+	DrainCommand   string `toml:"drain_command,omitempty"`
+	UndrainCommand string `toml:"undrain_command,omitempty"`
+}
+
+type MaintenanceConfig struct {
+	Marker  string `toml:"marker,omitempty"`
+	Page    string `toml:"page,omitempty"`
+	WebRoot string `toml:"web_root,omitempty"`
+	From    string `toml:"from,omitempty"`
+	Until   string `toml:"until,omitempty"`
+}
+
+type HooksConfig struct {
+	TTY bool `toml:"tty"`
+}
+
 type SharedConfig struct {
 	Dirs  []string `toml:"dirs"`
 	Files []string `toml:"files"`
 }
 
+type VerifyConfig struct {
+	Probes       []ProbeConfig `toml:"probe,omitempty"`
+	Bake         string        `toml:"bake"`
+	BakeInterval string        `toml:"bake_interval"`
+	BakeFailures int           `toml:"bake_failures"`
+}
+
+type ProbeConfig struct {
+	Name string `toml:"name,omitempty"`
+	Type string `toml:"type"`
+
+	// http
+	URL      string            `toml:"url,omitempty"`
+	Method   string            `toml:"method,omitempty"`
+	Status   int               `toml:"status,omitempty"`
+	Body     string            `toml:"body,omitempty"`
+	Headers  map[string]string `toml:"headers,omitempty"`
+	Insecure bool              `toml:"insecure,omitempty"`
+
+	// tcp
+	Address string `toml:"address,omitempty"`
+
+	// command
+	Command string `toml:"command,omitempty"`
+
+	Retries      int    `toml:"retries,omitempty"`
+	Interval     string `toml:"interval,omitempty"`
+	Timeout      string `toml:"timeout,omitempty"`
+	InitialDelay string `toml:"initial_delay,omitempty"`
+}
+
+type SuperviseConfig struct {
+	GracePeriod string `toml:"grace_period"`
+	Backoff     string `toml:"backoff"`
+	MaxBackoff  string `toml:"max_backoff"`
+}
+
 func Default() *Config {
 	c := &Config{}
 
@@ -50,6 +239,16 @@ func Default() *Config {
 	c.Deploy.Jitter.Max = 10
 	c.Deploy.Shared.Dirs = []string{}
 	c.Deploy.Shared.Files = []string{}
+	c.Deploy.Hooks.TTY = false
+	c.Deploy.BlueGreen.Enabled = false
+
+	c.Verify.Bake = ""
+	c.Verify.BakeInterval = "30s"
+	c.Verify.BakeFailures = 1
+
+	c.Supervise.GracePeriod = "10s"
+	c.Supervise.Backoff = "1s"
+	c.Supervise.MaxBackoff = "1m"
 
 	return c
 }
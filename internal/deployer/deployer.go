@@ -5,14 +5,24 @@ import (
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/serversfordev/deploy/internal/bluegreen"
 	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/drain"
 	"github.com/serversfordev/deploy/internal/hook"
 	"github.com/serversfordev/deploy/internal/lock"
 	"github.com/serversfordev/deploy/internal/logger"
+	"github.com/serversfordev/deploy/internal/maintenance"
+	"github.com/serversfordev/deploy/internal/probe"
 	"github.com/serversfordev/deploy/internal/provider"
 	"github.com/serversfordev/deploy/internal/release"
+	"github.com/serversfordev/deploy/internal/reload"
+	"github.com/serversfordev/deploy/internal/utils"
 )
 
 type State string
@@ -23,21 +33,29 @@ const (
 	StateClone         State = "clone"
 	StateBuild         State = "build"
 	StateDeploy        State = "deploy"
+	StateStartIdle     State = "start_idle"
+	StateVerifyIdle    State = "verify_idle"
+	StateSwitch        State = "switch"
 	StatePostDeploy    State = "post_deploy"
 	StateVerify        State = "verify"
+	StateBake          State = "bake"
 	StateError         State = "error"
 	StateFinalize      State = "finalize"
 	StateEnd           State = "end"
 )
 
 var stateTransitions = map[State][]State{
-	StateInit:          {StateDetectChanges, StateError},
+	StateInit:          {StateDetectChanges, StateFinalize, StateError},
 	StateDetectChanges: {StateClone, StateFinalize, StateError},
 	StateClone:         {StateBuild, StateError},
 	StateBuild:         {StateDeploy, StateError},
-	StateDeploy:        {StatePostDeploy, StateError},
+	StateDeploy:        {StateStartIdle, StatePostDeploy, StateError},
+	StateStartIdle:     {StateVerifyIdle, StateError},
+	StateVerifyIdle:    {StateSwitch, StateError},
+	StateSwitch:        {StatePostDeploy, StateError},
 	StatePostDeploy:    {StateVerify, StateError},
-	StateVerify:        {StateFinalize, StateError},
+	StateVerify:        {StateBake, StateError},
+	StateBake:          {StateFinalize, StateError},
 	StateError:         {StateFinalize},
 	StateFinalize:      {StateEnd},
 }
@@ -48,9 +66,23 @@ type Context struct {
 	Provider      provider.Provider
 	AppDir        string
 	Force         bool
+	Ref           string
 	NewReleaseDir string
+	Revision      string
 
 	rollbackFuncs []func() error
+
+	// the host was taken out of the load balancer pool
+	drained bool
+
+	// maintenance mode was enabled by the deployment
+	maintenance bool
+
+	// blue/green deployments
+	slot                bluegreen.Slot
+	slotPort            int
+	previousSlot        bluegreen.Slot
+	previousSlotStopped bool
 }
 
 func (ctx *Context) AddRollbackFunc(fn func() error) {
@@ -69,6 +101,286 @@ func (ctx *Context) ExecuteRollback() {
 	ctx.rollbackFuncs = nil
 }
 
+func (ctx *Context) hookOptions() hook.Options {
+	return hook.Options{
+		AppDir:     ctx.AppDir,
+		ReleaseDir: ctx.NewReleaseDir,
+		Revision:   ctx.Revision,
+		Output:     ctx.Logger.Output(),
+		Logf:       ctx.Logger.Printf,
+		TTY:        ctx.Config.Deploy.Hooks.TTY,
+	}
+}
+
+func (ctx *Context) reloadOptions(releaseDir string) reload.Options {
+	return reload.Options{
+		AppDir:     ctx.AppDir,
+		ReleaseDir: releaseDir,
+		Logf:       ctx.Logger.Printf,
+	}
+}
+
+// drain takes the host out of the load balancer pool and waits for the
+// configured period. It registers the undrain for the rollback and returns
+// false if anything failed.
+func (ctx *Context) drain() bool {
+	wait, err := utils.ParseDuration(ctx.Config.Deploy.Drain.Wait, 0)
+	if err != nil {
+		ctx.Logger.Printf("invalid drain wait period: %s", err)
+		return false
+	}
+
+	// undrain in case of failure, even if draining itself failed halfway
+	ctx.AddRollbackFunc(func() error {
+		if !ctx.drained {
+			return nil
+		}
+
+		ctx.Logger.Printf("undraining host")
+		if err := drain.Undrain(ctx.Config.Deploy.Drain); err != nil {
+			return err
+		}
+		ctx.drained = false
+
+		return nil
+	})
+
+	ctx.Logger.Printf("draining host")
+	ctx.drained = true
+	if err := drain.Drain(ctx.Config.Deploy.Drain); err != nil {
+		ctx.Logger.Printf("failed to drain host: %s", err)
+		return false
+	}
+
+	if wait > 0 {
+		ctx.Logger.Printf("waiting %s for connections to drain", wait)
+		time.Sleep(wait)
+	}
+
+	return true
+}
+
+// remoteUnchanged reports whether the remote revision is the revision of the
+// current release, which makes fetching the source unnecessary. Any failure
+// falls back to the full change detection.
+func (ctx *Context) remoteUnchanged() bool {
+	currentRevision, err := release.CurrentRevision(ctx.AppDir)
+	if err != nil {
+		return false
+	}
+
+	remoteRevision, err := ctx.Provider.RemoteRevision()
+	if err != nil {
+		ctx.Logger.Printf("failed to get remote revision: %s", err)
+		return false
+	}
+
+	return remoteRevision != "" && remoteRevision == currentRevision
+}
+
+// sourceMetadata returns the details the provider reported about the source,
+// if it reports any.
+func (ctx *Context) sourceMetadata() map[string]string {
+	if p, ok := ctx.Provider.(provider.MetadataProvider); ok {
+		return p.Metadata()
+	}
+	return nil
+}
+
+// maintenanceWindow returns the states maintenance mode is enabled on
+// entering and disabled on leaving. It defaults to the deploy state.
+func (ctx *Context) maintenanceWindow() (State, State) {
+	from := State(ctx.Config.Deploy.Maintenance.From)
+	if from == "" {
+		from = StateDeploy
+	}
+	until := State(ctx.Config.Deploy.Maintenance.Until)
+	if until == "" {
+		until = from
+	}
+
+	return from, until
+}
+
+// enableMaintenance enables maintenance mode, unless it's already enabled,
+// e.g. manually. Only maintenance mode enabled by the deployment is disabled
+// by it.
+func (ctx *Context) enableMaintenance() bool {
+	enabled, err := maintenance.Enabled(ctx.AppDir, ctx.Config.Deploy.Maintenance)
+	if err != nil {
+		ctx.Logger.Printf("failed to check maintenance mode: %s", err)
+		return false
+	}
+	if enabled {
+		ctx.Logger.Printf("maintenance mode is already enabled, leaving it enabled")
+		return true
+	}
+
+	ctx.Logger.Printf("enabling maintenance mode")
+	ctx.maintenance = true
+	if err := maintenance.Enable(ctx.AppDir, ctx.Config.Deploy.Maintenance); err != nil {
+		ctx.Logger.Printf("failed to enable maintenance mode: %s", err)
+		return false
+	}
+
+	return true
+}
+
+func (ctx *Context) disableMaintenance() {
+	if !ctx.maintenance {
+		return
+	}
+
+	ctx.Logger.Printf("disabling maintenance mode")
+	if err := maintenance.Disable(ctx.AppDir, ctx.Config.Deploy.Maintenance); err != nil {
+		ctx.Logger.Printf("failed to disable maintenance mode: %s", err)
+		return
+	}
+	ctx.maintenance = false
+}
+
+// activate points the current symlink to the new release and runs the reload
+// actions. It registers the rollback to the previous release and returns
+// false if anything failed.
+func (ctx *Context) activate() bool {
+	ctx.Logger.Printf("updating current release")
+	err := release.UpdateCurrent(ctx.AppDir, ctx.NewReleaseDir)
+	if err != nil {
+		ctx.Logger.Printf("failed to update current release: %s", err)
+		return false
+	}
+
+	// rollback in case of failure
+	ctx.AddRollbackFunc(func() error {
+		ctx.Logger.Printf("rolling back")
+		if err := release.Rollback(ctx.AppDir); err != nil {
+			return err
+		}
+
+		if len(ctx.Config.Deploy.Reload) == 0 {
+			return nil
+		}
+
+		previousReleaseDir, err := release.Current(ctx.AppDir)
+		if err != nil {
+			return err
+		}
+
+		ctx.Logger.Printf("reloading services for the previous release")
+		return reload.Run(ctx.Config.Deploy.Reload, ctx.reloadOptions(previousReleaseDir))
+	})
+
+	if len(ctx.Config.Deploy.Reload) > 0 {
+		ctx.Logger.Printf("reloading services")
+		if err := reload.Run(ctx.Config.Deploy.Reload, ctx.reloadOptions(ctx.NewReleaseDir)); err != nil {
+			ctx.Logger.Printf("failed to reload services: %s", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ctx *Context) slotGracePeriod() time.Duration {
+	gracePeriod, err := utils.ParseDuration(ctx.Config.Deploy.BlueGreen.GracePeriod, 10*time.Second)
+	if err != nil {
+		ctx.Logger.Printf("invalid grace period, using the default: %s", err)
+		return 10 * time.Second
+	}
+	return gracePeriod
+}
+
+// probes returns the configured health probes. In blue/green mode $PORT and
+// ${PORT} are replaced with the port of the new slot.
+func (ctx *Context) probes() []config.ProbeConfig {
+	if ctx.slotPort == 0 {
+		return ctx.Config.Verify.Probes
+	}
+
+	port := strconv.Itoa(ctx.slotPort)
+	expand := func(value string) string {
+		return portPattern.ReplaceAllString(value, port)
+	}
+
+	probes := make([]config.ProbeConfig, 0, len(ctx.Config.Verify.Probes))
+	for _, p := range ctx.Config.Verify.Probes {
+		p.URL = expand(p.URL)
+		p.Address = expand(p.Address)
+		p.Command = expand(p.Command)
+		probes = append(probes, p)
+	}
+
+	return probes
+}
+
+var portPattern = regexp.MustCompile(`\$\{PORT\}|\$PORT\b`)
+
+// runProbes runs the configured health probes against the new release and
+// logs the result of each. It returns false if any of the probes failed.
+func (ctx *Context) runProbes() bool {
+	results, ok := probe.RunAll(ctx.probes(), probe.Options{
+		Dir:  ctx.NewReleaseDir,
+		Logf: ctx.Logger.Printf,
+	})
+
+	for _, result := range results {
+		if result.Err != nil {
+			ctx.Logger.Printf("probe %s: failed after %d attempt(s) in %s: %s", result.Name, result.Attempts, result.Duration.Round(time.Millisecond), result.Err)
+			continue
+		}
+		ctx.Logger.Printf("probe %s: passed after %d attempt(s) in %s", result.Name, result.Attempts, result.Duration.Round(time.Millisecond))
+	}
+
+	return ok
+}
+
+// bake keeps checking the release with the health probes and the watch hook
+// for the given duration. It returns false as soon as the number of failed
+// checks reaches the configured threshold.
+func (ctx *Context) bake(duration time.Duration) bool {
+	interval, err := utils.ParseDuration(ctx.Config.Verify.BakeInterval, 30*time.Second)
+	if err != nil {
+		ctx.Logger.Printf("invalid bake interval: %s", err)
+		return false
+	}
+	if interval <= 0 {
+		ctx.Logger.Printf("invalid bake interval: %s, must be positive", interval)
+		return false
+	}
+
+	maxFailures := ctx.Config.Verify.BakeFailures
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+
+	failures := 0
+	deadline := time.Now().Add(duration)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return true
+		}
+		time.Sleep(min(interval, remaining))
+
+		ok := true
+		if len(ctx.Config.Verify.Probes) > 0 && !ctx.runProbes() {
+			ok = false
+		}
+		if err := hook.ExecuteHook(hook.HookWatch, ctx.hookOptions()); err != nil {
+			ctx.Logger.Printf("failed to execute watch hook: %s", err)
+			ok = false
+		}
+
+		if !ok {
+			failures++
+			ctx.Logger.Printf("bake check failed (%d/%d)", failures, maxFailures)
+			if failures >= maxFailures {
+				return false
+			}
+		}
+	}
+}
+
 type StateHandler func(ctx *Context) (State, error)
 
 var stateHandlers = map[State]StateHandler{
@@ -91,11 +403,45 @@ var stateHandlers = map[State]StateHandler{
 			time.Sleep(time.Duration(jitterSeconds * float64(time.Second)))
 		}
 
+		if maintenance.Configured(ctx.Config.Deploy.Maintenance) {
+			from, until := ctx.maintenanceWindow()
+			for _, state := range []State{from, until} {
+				if _, ok := stateTransitions[state]; !ok || state == StateInit || state == StateError || state == StateFinalize {
+					ctx.Logger.Printf("invalid maintenance window state: %s", state)
+					return StateError, nil
+				}
+			}
+		}
+
+		if !ctx.Force && ctx.Ref == "" && ctx.remoteUnchanged() {
+			ctx.Logger.Printf("remote revision is already deployed, skipping deployment")
+			return StateFinalize, nil
+		}
+
 		if err := ctx.Provider.Init(); err != nil {
 			ctx.Logger.Printf("failed to initialize provider: %s", err)
 			return StateError, nil
 		}
 
+		if ctx.Ref != "" {
+			revision, err := ctx.Provider.ResolveRef(ctx.Ref)
+			if err != nil {
+				ctx.Logger.Printf("failed to resolve ref: %s", err)
+				return StateError, nil
+			}
+			ctx.Logger.Printf("pinned to ref %s at %s", ctx.Ref, revision)
+		}
+
+		source := ctx.sourceMetadata()
+		keys := make([]string, 0, len(source))
+		for key := range source {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ctx.Logger.Printf("source %s: %s", strings.ReplaceAll(key, "_", " "), source[key])
+		}
+
 		return StateDetectChanges, nil
 	},
 
@@ -118,7 +464,19 @@ var stateHandlers = map[State]StateHandler{
 			return StateError, nil
 		}
 
-		if currentRevision != providerRevision {
+		changed := currentRevision != providerRevision
+		if detector, ok := ctx.Provider.(provider.ChangeDetector); ok && changed {
+			changed, err = detector.Changed(currentRevision, providerRevision)
+			if err != nil {
+				ctx.Logger.Printf("failed to detect changes: %s", err)
+				return StateError, nil
+			}
+			if !changed {
+				ctx.Logger.Printf("new revision %s doesn't change the watched paths", providerRevision)
+			}
+		}
+
+		if changed {
 			ctx.Logger.Printf("changes detected")
 			return StateClone, nil
 		}
@@ -142,6 +500,8 @@ var stateHandlers = map[State]StateHandler{
 			return StateError, nil
 		}
 
+		ctx.Revision = providerRevision
+
 		ctx.NewReleaseDir, err = release.NewRelease(ctx.AppDir, providerRevision)
 		if err != nil {
 			ctx.Logger.Printf("failed to create new release: %s", err)
@@ -155,13 +515,24 @@ var stateHandlers = map[State]StateHandler{
 		})
 		ctx.Logger.Printf("new release directory created: %s", providerRevision)
 
+		if source := ctx.sourceMetadata(); len(source) > 0 || ctx.Ref != "" {
+			if err := release.UpdateMetadata(ctx.NewReleaseDir, func(metadata *release.Metadata) {
+				metadata.Source = source
+				metadata.Ref = ctx.Ref
+				metadata.Pinned = ctx.Ref != ""
+			}); err != nil {
+				ctx.Logger.Printf("failed to update release metadata: %s", err)
+				return StateError, nil
+			}
+		}
+
 		if err := ctx.Provider.Clone(ctx.NewReleaseDir); err != nil {
 			ctx.Logger.Printf("failed to clone provider: %s", err)
 			return StateError, nil
 		}
 
 		ctx.Logger.Printf("executing clone hook")
-		if err := hook.ExecuteHook(ctx.NewReleaseDir, hook.HookClone); err != nil {
+		if err := hook.ExecuteHook(hook.HookClone, ctx.hookOptions()); err != nil {
 			ctx.Logger.Printf("failed to execute clone hook: %s", err)
 			return StateError, nil
 		}
@@ -196,7 +567,7 @@ var stateHandlers = map[State]StateHandler{
 
 	StateBuild: func(ctx *Context) (State, error) {
 		ctx.Logger.Printf("executing build hook")
-		if err := hook.ExecuteHook(ctx.NewReleaseDir, hook.HookBuild); err != nil {
+		if err := hook.ExecuteHook(hook.HookBuild, ctx.hookOptions()); err != nil {
 			ctx.Logger.Printf("failed to execute build hook: %s", err)
 			return StateError, nil
 		}
@@ -206,30 +577,132 @@ var stateHandlers = map[State]StateHandler{
 
 	StateDeploy: func(ctx *Context) (State, error) {
 		ctx.Logger.Printf("executing deploy hook")
-		if err := hook.ExecuteHook(ctx.NewReleaseDir, hook.HookDeploy); err != nil {
+		if err := hook.ExecuteHook(hook.HookDeploy, ctx.hookOptions()); err != nil {
 			ctx.Logger.Printf("failed to execute deploy hook: %s", err)
 			return StateError, nil
 		}
 
-		ctx.Logger.Printf("updating current release")
-		err := release.UpdateCurrent(ctx.AppDir, ctx.NewReleaseDir)
+		if ctx.Config.Deploy.Drain.Type != "" && !ctx.drain() {
+			return StateError, nil
+		}
+
+		if ctx.Config.Deploy.BlueGreen.Enabled {
+			return StateStartIdle, nil
+		}
+
+		if !ctx.activate() {
+			return StateError, nil
+		}
+
+		return StatePostDeploy, nil
+	},
+
+	StateStartIdle: func(ctx *Context) (State, error) {
+		state, err := bluegreen.ReadState(ctx.AppDir)
+		if err != nil {
+			ctx.Logger.Printf("failed to read blue/green state: %s", err)
+			return StateError, nil
+		}
+
+		ctx.previousSlot = state.Active
+		ctx.slot = state.Idle()
+		ctx.slotPort, err = bluegreen.Port(ctx.Config.Deploy.BlueGreen, ctx.slot)
 		if err != nil {
-			ctx.Logger.Printf("failed to update current release: %s", err)
+			ctx.Logger.Printf("invalid blue/green configuration: %s", err)
+			return StateError, nil
+		}
+
+		ctx.Logger.Printf("starting %s slot on port %d", ctx.slot, ctx.slotPort)
+		if err := bluegreen.Start(ctx.AppDir, ctx.Config.Deploy.BlueGreen, ctx.slot, ctx.NewReleaseDir); err != nil {
+			ctx.Logger.Printf("failed to start %s slot: %s", ctx.slot, err)
+			return StateError, nil
+		}
+
+		// stop the new slot in case of failure
+		ctx.AddRollbackFunc(func() error {
+			ctx.Logger.Printf("stopping %s slot", ctx.slot)
+			return bluegreen.Stop(ctx.AppDir, ctx.slot, ctx.slotGracePeriod())
+		})
+
+		return StateVerifyIdle, nil
+	},
+
+	StateVerifyIdle: func(ctx *Context) (State, error) {
+		if len(ctx.Config.Verify.Probes) == 0 {
+			ctx.Logger.Printf("no health probes configured, switching to the %s slot unverified", ctx.slot)
+			return StateSwitch, nil
+		}
+
+		ctx.Logger.Printf("verifying %s slot on port %d", ctx.slot, ctx.slotPort)
+		if !ctx.runProbes() {
+			ctx.Logger.Printf("health probes of the %s slot failed", ctx.slot)
+			return StateError, nil
+		}
+
+		return StateSwitch, nil
+	},
+
+	StateSwitch: func(ctx *Context) (State, error) {
+		ctx.Logger.Printf("switching traffic to the %s slot", ctx.slot)
+		if err := bluegreen.Switch(ctx.AppDir, ctx.Config.Deploy.BlueGreen, ctx.slot); err != nil {
+			ctx.Logger.Printf("failed to switch traffic: %s", err)
 			return StateError, nil
 		}
 
-		// rollback in case of failure
+		// switch back in case of failure
 		ctx.AddRollbackFunc(func() error {
-			ctx.Logger.Printf("rolling back")
-			return release.Rollback(ctx.AppDir)
+			if ctx.previousSlot == "" {
+				return nil
+			}
+
+			if ctx.previousSlotStopped {
+				state, err := bluegreen.ReadState(ctx.AppDir)
+				if err != nil {
+					return err
+				}
+
+				ctx.Logger.Printf("restarting %s slot", ctx.previousSlot)
+				err = bluegreen.Start(ctx.AppDir, ctx.Config.Deploy.BlueGreen, ctx.previousSlot, state.Slots[ctx.previousSlot].Release)
+				if err != nil {
+					return err
+				}
+			}
+
+			ctx.Logger.Printf("switching traffic back to the %s slot", ctx.previousSlot)
+			return bluegreen.Switch(ctx.AppDir, ctx.Config.Deploy.BlueGreen, ctx.previousSlot)
 		})
 
+		if !ctx.activate() {
+			return StateError, nil
+		}
+
+		if ctx.previousSlot == "" {
+			return StatePostDeploy, nil
+		}
+
+		drain, err := utils.ParseDuration(ctx.Config.Deploy.BlueGreen.Drain, 0)
+		if err != nil {
+			ctx.Logger.Printf("invalid drain duration: %s", err)
+			return StateError, nil
+		}
+		drain = max(drain, bluegreen.SwitchDelay(ctx.Config.Deploy.BlueGreen))
+		if drain > 0 {
+			ctx.Logger.Printf("draining %s slot for %s", ctx.previousSlot, drain)
+			time.Sleep(drain)
+		}
+
+		ctx.Logger.Printf("stopping %s slot", ctx.previousSlot)
+		if err := bluegreen.Stop(ctx.AppDir, ctx.previousSlot, ctx.slotGracePeriod()); err != nil {
+			ctx.Logger.Printf("failed to stop %s slot: %s", ctx.previousSlot, err)
+		}
+		ctx.previousSlotStopped = true
+
 		return StatePostDeploy, nil
 	},
 
 	StatePostDeploy: func(ctx *Context) (State, error) {
 		ctx.Logger.Printf("executing post deploy hook")
-		if err := hook.ExecuteHook(ctx.NewReleaseDir, hook.HookPostDeploy); err != nil {
+		if err := hook.ExecuteHook(hook.HookPostDeploy, ctx.hookOptions()); err != nil {
 			ctx.Logger.Printf("failed to execute post deploy hook: %s", err)
 			return StateError, nil
 		}
@@ -239,12 +712,57 @@ var stateHandlers = map[State]StateHandler{
 
 	StateVerify: func(ctx *Context) (State, error) {
 		ctx.Logger.Printf("executing verify hook")
-		if err := hook.ExecuteHook(ctx.NewReleaseDir, hook.HookVerify); err != nil {
+		if err := hook.ExecuteHook(hook.HookVerify, ctx.hookOptions()); err != nil {
 			ctx.Logger.Printf("verification hook returned with a non-zero exit code")
 
 			return StateError, nil
 		}
 
+		if len(ctx.Config.Verify.Probes) > 0 {
+			ctx.Logger.Printf("running health probes")
+			if !ctx.runProbes() {
+				ctx.Logger.Printf("health probes failed")
+				return StateError, nil
+			}
+		}
+
+		if ctx.drained {
+			ctx.Logger.Printf("undraining host")
+			if err := drain.Undrain(ctx.Config.Deploy.Drain); err != nil {
+				ctx.Logger.Printf("failed to undrain host: %s", err)
+				return StateError, nil
+			}
+			ctx.drained = false
+		}
+
+		return StateBake, nil
+	},
+
+	StateBake: func(ctx *Context) (State, error) {
+		duration, err := utils.ParseDuration(ctx.Config.Verify.Bake, 0)
+		if err != nil {
+			ctx.Logger.Printf("invalid bake duration: %s", err)
+			return StateError, nil
+		}
+
+		if duration > 0 {
+			ctx.Logger.Printf("baking release for %s", duration)
+			if !ctx.bake(duration) {
+				ctx.Logger.Printf("release failed during the bake period")
+				return StateError, nil
+			}
+		}
+
+		ctx.Logger.Printf("marking release as good")
+		err = release.UpdateMetadata(ctx.NewReleaseDir, func(metadata *release.Metadata) {
+			now := time.Now()
+			metadata.Status = release.StatusGood
+			metadata.VerifiedAt = &now
+		})
+		if err != nil {
+			ctx.Logger.Printf("failed to update release metadata: %s", err)
+		}
+
 		return StateFinalize, nil
 	},
 
@@ -264,6 +782,9 @@ var stateHandlers = map[State]StateHandler{
 			ctx.Logger.Printf("failed to cleanup old releases: %s", err)
 		}
 
+		// never leave maintenance mode enabled, even after an error
+		ctx.disableMaintenance()
+
 		ctx.Logger.Printf("releasing lock")
 		if err := lock.Release(ctx.AppDir); err != nil {
 			ctx.Logger.Printf("failed to release lock: %s", err)
@@ -300,7 +821,7 @@ func (d *Deployer) Execute(ctx *Context) error {
 			return fmt.Errorf("no handler for state: %s", d.currentState)
 		}
 
-		nextState, err := handler(ctx)
+		nextState, err := d.handle(ctx, handler)
 		if err != nil {
 			return err
 		}
@@ -315,6 +836,30 @@ func (d *Deployer) Execute(ctx *Context) error {
 	return nil
 }
 
+// handle runs the handler of the current state, enabling maintenance mode
+// before the first state of the maintenance window and disabling it after
+// the last one.
+func (d *Deployer) handle(ctx *Context, handler StateHandler) (State, error) {
+	if !maintenance.Configured(ctx.Config.Deploy.Maintenance) {
+		return handler(ctx)
+	}
+
+	from, until := ctx.maintenanceWindow()
+	if d.currentState == from && !ctx.maintenance {
+		if !ctx.enableMaintenance() {
+			return StateError, nil
+		}
+	}
+
+	nextState, err := handler(ctx)
+
+	if d.currentState == until {
+		ctx.disableMaintenance()
+	}
+
+	return nextState, err
+}
+
 func (d *Deployer) isValidTransition(next State) bool {
 	validStates, exists := d.transitions[d.currentState]
 	if !exists {
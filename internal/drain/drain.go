@@ -0,0 +1,113 @@
+package drain
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+)
+
+const (
+	TypeHAProxy = "haproxy"
+	TypeFile    = "file"
+	TypeCommand = "command"
+)
+
+const socketTimeout = 10 * time.Second
+
+// Drain takes the host out of the load balancer pool.
+func Drain(cfg config.DrainConfig) error {
+	switch cfg.Type {
+	case TypeHAProxy:
+		return setServerState(cfg, "drain")
+	case TypeFile:
+		if cfg.Path == "" {
+			return fmt.Errorf("file drain requires a path")
+		}
+		if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(cfg.Path, []byte("drain\n"), 0644)
+	case TypeCommand:
+		return runCommand(cfg.DrainCommand)
+	default:
+		return fmt.Errorf("unknown drain type: %s", cfg.Type)
+	}
+}
+
+// Undrain puts the host back into the load balancer pool.
+func Undrain(cfg config.DrainConfig) error {
+	switch cfg.Type {
+	case TypeHAProxy:
+		return setServerState(cfg, "ready")
+	case TypeFile:
+		if err := os.Remove(cfg.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case TypeCommand:
+		return runCommand(cfg.UndrainCommand)
+	default:
+		return fmt.Errorf("unknown drain type: %s", cfg.Type)
+	}
+}
+
+// setServerState changes the state of the server through the HAProxy runtime
+// API. The socket is either the path of a unix socket or a host:port.
+func setServerState(cfg config.DrainConfig, state string) error {
+	if cfg.Socket == "" || cfg.Backend == "" || cfg.Server == "" {
+		return fmt.Errorf("haproxy drain requires a socket, a backend and a server")
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(cfg.Socket, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, cfg.Socket, socketTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to haproxy: %w", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(socketTimeout))
+
+	command := fmt.Sprintf("set server %s/%s state %s\n", cfg.Backend, cfg.Server, state)
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return fmt.Errorf("failed to send command to haproxy: %w", err)
+	}
+
+	// the runtime API answers with an empty line on success, and closes the
+	// connection after a single command
+	var response strings.Builder
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		response.WriteString(scanner.Text())
+	}
+	if message := strings.TrimSpace(response.String()); message != "" {
+		return fmt.Errorf("haproxy: %s", message)
+	}
+
+	return nil
+}
+
+func runCommand(command string) error {
+	if command == "" {
+		return fmt.Errorf("command drain requires a drain_command and an undrain_command")
+	}
+
+	output, err := exec.Command("/bin/sh", "-c", command).CombinedOutput()
+	output = bytes.TrimSpace(output)
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+
+	return err
+}
@@ -2,9 +2,13 @@ package hook
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
+
+	"github.com/creack/pty"
 )
 
 type Hook string
@@ -15,23 +19,126 @@ const (
 	HookDeploy     Hook = "deploy"
 	HookPostDeploy Hook = "post_deploy"
 	HookVerify     Hook = "verify"
+	HookWatch      Hook = "watch"
 )
 
-func ExecuteHook(releaseDir string, hook Hook) error {
-	hookPath := filepath.Join(releaseDir, ".deploy", "hooks", string(hook))
+// nonInteractiveEnv is added to the environment of every hook, so tools that
+// would otherwise prompt for input pick their defaults instead of waiting.
+var nonInteractiveEnv = []string{
+	"CI=true",
+	"DEBIAN_FRONTEND=noninteractive",
+	"GIT_TERMINAL_PROMPT=0",
+	"COMPOSER_NO_INTERACTION=1",
+}
+
+type Options struct {
+	// AppDir is the application directory holding releases and shared files.
+	AppDir string
+	// ReleaseDir is the release directory the hook is loaded from and run in.
+	ReleaseDir string
+	// Revision is the source revision of the release.
+	Revision string
+	// Output receives the combined stdout and stderr of the hook.
+	Output io.Writer
+	// Logf writes a message to the deployment log.
+	Logf func(format string, v ...interface{})
+	// TTY runs the hook with its output attached to a pseudo-terminal.
+	TTY bool
+}
+
+// ExecuteHook runs the given hook of the release. A Starlark script
+// (.deploy/hooks/<hook>.star) takes precedence over an executable
+// (.deploy/hooks/<hook>). Missing hooks are skipped.
+func ExecuteHook(hook Hook, opts Options) error {
+	hookPath := filepath.Join(opts.ReleaseDir, ".deploy", "hooks", string(hook))
+
+	if _, err := os.Stat(hookPath + ".star"); err == nil {
+		if err := executeScript(hook, hookPath+".star", opts); err != nil {
+			return fmt.Errorf("failed to execute hook %s: %w", hook, err)
+		}
+		return nil
+	}
 
 	if _, err := os.Stat(hookPath); os.IsNotExist(err) {
 		return nil
 	}
 
 	cmd := exec.Command(hookPath)
-	cmd.Dir = releaseDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Dir = opts.ReleaseDir
 
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(cmd, opts); err != nil {
 		return fmt.Errorf("failed to execute hook %s: %w", hook, err)
 	}
 
 	return nil
 }
+
+// environment returns the environment of hooks and the commands they run.
+func environment(opts Options) []string {
+	env := append(os.Environ(), nonInteractiveEnv...)
+
+	return append(env,
+		"DEPLOY_APP_DIR="+opts.AppDir,
+		"DEPLOY_RELEASE_DIR="+opts.ReleaseDir,
+		"DEPLOY_SHARED_DIR="+sharedDir(opts),
+		"DEPLOY_REVISION="+opts.Revision,
+	)
+}
+
+func sharedDir(opts Options) string {
+	return filepath.Join(opts.AppDir, "shared")
+}
+
+func runCommand(cmd *exec.Cmd, opts Options) error {
+	cmd.Env = append(environment(opts), cmd.Env...)
+
+	// hooks never read from the terminal, stdin is always /dev/null
+	cmd.Stdin = nil
+
+	if opts.TTY {
+		return runWithPTY(cmd, opts.Output)
+	}
+
+	cmd.Stdout = opts.Output
+	cmd.Stderr = opts.Output
+
+	return cmd.Run()
+}
+
+// runWithPTY runs the command with stdout and stderr attached to a
+// pseudo-terminal, for tools that only colorize or report progress when
+// writing to a terminal. Stdin stays detached, so prompts still can't block.
+func runWithPTY(cmd *exec.Cmd, output io.Writer) error {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open pseudo-terminal: %w", err)
+	}
+	defer ptmx.Close()
+
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+		Ctty:    1,
+	}
+
+	if err := cmd.Start(); err != nil {
+		tty.Close()
+		return err
+	}
+	// the child holds its own copy of the terminal
+	tty.Close()
+
+	copied := make(chan struct{})
+	go func() {
+		// reading fails with EIO once the child closed the terminal
+		_, _ = io.Copy(output, ptmx)
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+	<-copied
+
+	return err
+}
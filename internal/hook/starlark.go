@@ -0,0 +1,248 @@
+package hook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/probe"
+)
+
+// executeScript runs a Starlark hook inside the deploy binary. The script gets
+// a predeclared "deploy" module exposing the deployment context:
+//
+//	deploy.app_dir, deploy.release_dir, deploy.shared_dir, deploy.revision
+//	deploy.hook                              name of the running hook
+//	deploy.env                               environment of the hook
+//	deploy.log(msg)                          write to the deployment log
+//	deploy.run(cmd, check=True, env={})      run a shell command, returns the exit code
+//	deploy.template(src, dest, vars={})      render a Go text/template file
+//	deploy.http_check(url, status=200, ...)  check an HTTP endpoint, returns a bool
+func executeScript(hook Hook, path string, opts Options) error {
+	thread := &starlark.Thread{
+		Name: string(hook),
+		Print: func(_ *starlark.Thread, msg string) {
+			opts.Logf("%s", msg)
+		},
+	}
+
+	env := starlark.NewDict(len(os.Environ()))
+	for _, kv := range environment(opts) {
+		key, value, _ := strings.Cut(kv, "=")
+		_ = env.SetKey(starlark.String(key), starlark.String(value))
+	}
+
+	s := &script{opts: opts}
+	module := &starlarkstruct.Module{
+		Name: "deploy",
+		Members: starlark.StringDict{
+			"app_dir":     starlark.String(opts.AppDir),
+			"release_dir": starlark.String(opts.ReleaseDir),
+			"shared_dir":  starlark.String(sharedDir(opts)),
+			"revision":    starlark.String(opts.Revision),
+			"hook":        starlark.String(hook),
+			"env":         env,
+			"log":         starlark.NewBuiltin("log", s.log),
+			"run":         starlark.NewBuiltin("run", s.run),
+			"template":    starlark.NewBuiltin("template", s.template),
+			"http_check":  starlark.NewBuiltin("http_check", s.httpCheck),
+		},
+	}
+	module.Freeze()
+
+	predeclared := starlark.StringDict{
+		"deploy": module,
+	}
+
+	// hooks are scripts, allow control flow and reassignment at the top level
+	fileOptions := &syntax.FileOptions{
+		Set:             true,
+		While:           true,
+		TopLevelControl: true,
+		GlobalReassign:  true,
+	}
+
+	_, err := starlark.ExecFileOptions(fileOptions, thread, path, nil, predeclared)
+	if err != nil {
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			return errors.New(evalErr.Backtrace())
+		}
+		return err
+	}
+
+	return nil
+}
+
+type script struct {
+	opts Options
+}
+
+func (s *script) log(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "msg", &msg); err != nil {
+		return nil, err
+	}
+
+	s.opts.Logf("%s", msg)
+
+	return starlark.None, nil
+}
+
+func (s *script) run(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var command string
+	check := true
+	var env *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "cmd", &command, "check?", &check, "env?", &env); err != nil {
+		return nil, err
+	}
+
+	extraEnv, err := toStringMap(env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = s.opts.ReleaseDir
+	for key, value := range extraEnv {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	err = runCommand(cmd, s.opts)
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return starlark.MakeInt(0), nil
+	case errors.As(err, &exitErr) && !check:
+		return starlark.MakeInt(exitErr.ExitCode()), nil
+	default:
+		return nil, fmt.Errorf("%s: command %q failed: %w", b.Name(), command, err)
+	}
+}
+
+func (s *script) template(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var src, dest string
+	var vars *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "src", &src, "dest", &dest, "vars?", &vars); err != nil {
+		return nil, err
+	}
+
+	templateVars, err := toStringMap(vars)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	src = s.path(src)
+	dest = s.path(dest)
+
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read template: %w", b.Name(), err)
+	}
+
+	tmpl, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to parse template: %w", b.Name(), err)
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environment(s.opts) {
+		key, value, _ := strings.Cut(kv, "=")
+		env[key] = value
+	}
+
+	data := map[string]interface{}{
+		"AppDir":     s.opts.AppDir,
+		"ReleaseDir": s.opts.ReleaseDir,
+		"SharedDir":  sharedDir(s.opts),
+		"Revision":   s.opts.Revision,
+		"Env":        env,
+		"Vars":       templateVars,
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("%s: failed to render template: %w", b.Name(), err)
+	}
+
+	if err := os.WriteFile(dest, buf.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("%s: failed to write %s: %w", b.Name(), dest, err)
+	}
+
+	return starlark.None, nil
+}
+
+func (s *script) httpCheck(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var url, body string
+	status := 200
+	timeout := 10
+	retries := 0
+	interval := 1
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"url", &url,
+		"status?", &status,
+		"body?", &body,
+		"timeout?", &timeout,
+		"retries?", &retries,
+		"interval?", &interval,
+	); err != nil {
+		return nil, err
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("%s: retries must not be negative, got %d", b.Name(), retries)
+	}
+
+	result := probe.Run(config.ProbeConfig{
+		Type:     probe.TypeHTTP,
+		URL:      url,
+		Status:   status,
+		Body:     body,
+		Retries:  retries,
+		Timeout:  fmt.Sprintf("%ds", timeout),
+		Interval: fmt.Sprintf("%ds", interval),
+	}, probe.Options{Logf: s.opts.Logf})
+
+	return starlark.Bool(result.Err == nil), nil
+}
+
+// path resolves paths relative to the release directory.
+func (s *script) path(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(s.opts.ReleaseDir, path)
+}
+
+func toStringMap(dict *starlark.Dict) (map[string]string, error) {
+	values := make(map[string]string)
+	if dict == nil {
+		return values, nil
+	}
+
+	for _, item := range dict.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("got %s key, want string", item[0].Type())
+		}
+
+		switch value := item[1].(type) {
+		case starlark.String:
+			values[key] = string(value)
+		default:
+			values[key] = value.String()
+		}
+	}
+
+	return values, nil
+}
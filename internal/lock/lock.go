@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 const lockFileName = "deploy.lock"
@@ -23,3 +24,31 @@ func Acquire(appDir string) error {
 func Release(appDir string) error {
 	return os.Remove(filepath.Join(appDir, lockFileName))
 }
+
+// Wait takes an exclusive lock on the file, creating it if needed, and waits
+// while another process holds it. The lock is held until the returned
+// function is called or the process exits.
+func Wait(path string) (func() error, error) {
+	return wait(path, syscall.LOCK_EX)
+}
+
+// WaitShared takes a shared lock on the file, like Wait. Any number of
+// processes can hold a shared lock at the same time, but not while another
+// process holds the exclusive lock.
+func WaitShared(path string) (func() error, error) {
+	return wait(path, syscall.LOCK_SH)
+}
+
+func wait(path string, how int) (func() error, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	return file.Close, nil
+}
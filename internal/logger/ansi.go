@@ -0,0 +1,83 @@
+package logger
+
+import "io"
+
+type ansiState int
+
+const (
+	ansiText ansiState = iota
+	ansiEscape
+	ansiIntermediate
+	ansiCSI
+	ansiOSC
+	ansiOSCEscape
+)
+
+// ansiStripper removes ANSI escape sequences (colors, cursor movement, window
+// titles) from everything written to it. It keeps its state between writes,
+// so sequences split across multiple writes are removed as well.
+type ansiStripper struct {
+	w     io.Writer
+	state ansiState
+}
+
+func (s *ansiStripper) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+
+	for _, b := range p {
+		switch s.state {
+		case ansiText:
+			if b == 0x1b {
+				s.state = ansiEscape
+				continue
+			}
+			out = append(out, b)
+		case ansiEscape:
+			switch b {
+			case '[':
+				s.state = ansiCSI
+			case ']':
+				s.state = ansiOSC
+			default:
+				s.escapeByte(b)
+			}
+		case ansiIntermediate:
+			s.escapeByte(b)
+		case ansiCSI:
+			// parameters and intermediate bytes until the final byte
+			if b >= 0x40 && b <= 0x7e {
+				s.state = ansiText
+			}
+		case ansiOSC:
+			// operating system commands end with BEL or ESC \
+			switch b {
+			case 0x07:
+				s.state = ansiText
+			case 0x1b:
+				s.state = ansiOSCEscape
+			}
+		case ansiOSCEscape:
+			s.state = ansiText
+		}
+	}
+
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// escapeByte handles a byte of an escape sequence other than CSI and OSC.
+// Intermediate bytes, e.g. the ( of ESC ( B, are followed by more bytes, a
+// final byte ends the sequence, e.g. ESC 7 or ESC =.
+func (s *ansiStripper) escapeByte(b byte) {
+	switch {
+	case b >= 0x20 && b <= 0x2f:
+		s.state = ansiIntermediate
+	case b == 0x1b:
+		s.state = ansiEscape
+	default:
+		s.state = ansiText
+	}
+}
@@ -9,7 +9,8 @@ import (
 )
 
 type Logger struct {
-	writers []io.Writer
+	console io.Writer
+	file    io.Writer
 }
 
 func New(appDir string) (*Logger, error) {
@@ -26,12 +27,13 @@ func New(appDir string) (*Logger, error) {
 	}
 
 	return &Logger{
-		writers: []io.Writer{os.Stdout, logFile},
+		console: os.Stdout,
+		file:    logFile,
 	}, nil
 }
 
 func (l *Logger) Write(p []byte) (n int, err error) {
-	for _, w := range l.writers {
+	for _, w := range []io.Writer{l.console, l.file} {
 		n, err = w.Write(p)
 		if err != nil {
 			return n, err
@@ -46,3 +48,10 @@ func (l *Logger) Printf(format string, v ...interface{}) {
 	formattedMessage := fmt.Sprintf("[%s] %s", timestamp, message)
 	_, _ = l.Write([]byte(formattedMessage))
 }
+
+// Output returns a writer for the output of external commands. The output is
+// passed to the console as is, but ANSI escape sequences are stripped before
+// it is written to the log file.
+func (l *Logger) Output() io.Writer {
+	return io.MultiWriter(l.console, &ansiStripper{w: l.file})
+}
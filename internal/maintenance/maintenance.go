@@ -0,0 +1,215 @@
+package maintenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/serversfordev/deploy/internal/config"
+)
+
+// the marker is valid JSON, Laravel parses its maintenance file
+const markerContent = "{}\n"
+
+const stateFileName = "maintenance.json"
+
+// state records where the page was copied to, so it's removed from the same
+// release when the web root is under current and current moved meanwhile.
+type state struct {
+	Page string `json:"page,omitempty"`
+}
+
+// Configured reports whether a marker or a page is configured.
+func Configured(cfg config.MaintenanceConfig) bool {
+	return cfg.Marker != "" || cfg.Page != ""
+}
+
+// Enable creates the marker file and copies the page into the web root.
+func Enable(appDir string, cfg config.MaintenanceConfig) error {
+	if !Configured(cfg) {
+		return fmt.Errorf("maintenance mode requires a marker or a page")
+	}
+
+	if cfg.Marker != "" {
+		marker := resolve(appDir, cfg.Marker)
+		if err := os.MkdirAll(filepath.Dir(marker), 0755); err != nil {
+			return fmt.Errorf("failed to create marker directory: %w", err)
+		}
+		if err := os.WriteFile(marker, []byte(markerContent), 0644); err != nil {
+			return fmt.Errorf("failed to write marker: %w", err)
+		}
+	}
+
+	if cfg.Page != "" {
+		target, err := pageTarget(appDir, cfg)
+		if err != nil {
+			return err
+		}
+
+		previous, err := readState(appDir)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(resolve(appDir, cfg.Page), target); err != nil {
+			return fmt.Errorf("failed to copy maintenance page: %w", err)
+		}
+		if err := writeState(appDir, &state{Page: target}); err != nil {
+			return err
+		}
+
+		// the page of a previous enable in another release
+		if previous.Page != "" && previous.Page != target {
+			if err := os.Remove(previous.Page); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove maintenance page: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Disable removes the marker file and the page from where it was copied to.
+// Disabling maintenance mode that isn't enabled is a no-op.
+func Disable(appDir string, cfg config.MaintenanceConfig) error {
+	if cfg.Marker != "" {
+		if err := os.Remove(resolve(appDir, cfg.Marker)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove marker: %w", err)
+		}
+	}
+
+	st, err := readState(appDir)
+	if err != nil {
+		return err
+	}
+	if st.Page != "" {
+		if err := os.Remove(st.Page); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove maintenance page: %w", err)
+		}
+		if err := os.Remove(filepath.Join(appDir, stateFileName)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove maintenance state: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Enabled reports whether the marker or the page is in place.
+func Enabled(appDir string, cfg config.MaintenanceConfig) (bool, error) {
+	paths := []string{}
+	if cfg.Marker != "" {
+		paths = append(paths, resolve(appDir, cfg.Marker))
+	}
+	if cfg.Page != "" {
+		st, err := readState(appDir)
+		if err != nil {
+			return false, err
+		}
+		if st.Page != "" {
+			paths = append(paths, st.Page)
+		}
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// pageTarget returns the path the page is copied to, with the symlinks of the
+// web root resolved, e.g. current/public to releases/<release>/public.
+func pageTarget(appDir string, cfg config.MaintenanceConfig) (string, error) {
+	if cfg.WebRoot == "" {
+		return "", fmt.Errorf("a maintenance page requires a web root")
+	}
+
+	webRoot := resolve(appDir, cfg.WebRoot)
+	if err := os.MkdirAll(webRoot, 0755); err != nil {
+		return "", fmt.Errorf("failed to create web root: %w", err)
+	}
+	webRoot, err := filepath.EvalSymlinks(webRoot)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve web root: %w", err)
+	}
+
+	return filepath.Join(webRoot, filepath.Base(cfg.Page)), nil
+}
+
+func readState(appDir string) (*state, error) {
+	st := &state{}
+
+	data, err := os.ReadFile(filepath.Join(appDir, stateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, fmt.Errorf("failed to read maintenance state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("failed to parse maintenance state: %w", err)
+	}
+
+	return st, nil
+}
+
+func writeState(appDir string, st *state) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal maintenance state: %w", err)
+	}
+
+	path := filepath.Join(appDir, stateFileName)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write maintenance state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write maintenance state: %w", err)
+	}
+
+	return nil
+}
+
+func resolve(appDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(appDir, path)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	// copy and rename, so the web server never serves a partial page
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dest)
+}
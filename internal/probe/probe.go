@@ -0,0 +1,261 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/utils"
+)
+
+const (
+	TypeHTTP    = "http"
+	TypeTCP     = "tcp"
+	TypeCommand = "command"
+)
+
+const (
+	defaultTimeout  = 5 * time.Second
+	defaultInterval = 2 * time.Second
+
+	commandWaitDelay = time.Second
+)
+
+// Result is the outcome of a probe, including all of its attempts.
+type Result struct {
+	Name     string
+	Attempts int
+	Duration time.Duration
+	Err      error
+}
+
+// Options configures the environment probes are run in.
+type Options struct {
+	// Dir is the working directory of command probes.
+	Dir string
+	// Logf writes a message to the deployment log.
+	Logf func(format string, v ...interface{})
+}
+
+// RunAll runs the probes in order and returns their results. It returns false
+// if any of the probes failed.
+func RunAll(probes []config.ProbeConfig, opts Options) ([]Result, bool) {
+	results := make([]Result, 0, len(probes))
+	ok := true
+
+	for _, p := range probes {
+		result := Run(p, opts)
+		if result.Err != nil {
+			ok = false
+		}
+		results = append(results, result)
+	}
+
+	return results, ok
+}
+
+// Run runs a single probe, retrying it until it succeeds or runs out of
+// attempts.
+func Run(p config.ProbeConfig, opts Options) Result {
+	result := Result{Name: Name(p)}
+	start := time.Now()
+
+	check, err := newCheck(p, opts)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// without an attempt, nothing would be checked
+	if p.Retries < 0 {
+		result.Err = fmt.Errorf("invalid retries: %d, must not be negative", p.Retries)
+		return result
+	}
+
+	initialDelay, err := utils.ParseDuration(p.InitialDelay, 0)
+	if err != nil {
+		result.Err = fmt.Errorf("invalid initial_delay: %w", err)
+		return result
+	}
+	interval, err := utils.ParseDuration(p.Interval, defaultInterval)
+	if err != nil {
+		result.Err = fmt.Errorf("invalid interval: %w", err)
+		return result
+	}
+	timeout, err := utils.ParseDuration(p.Timeout, defaultTimeout)
+	if err != nil {
+		result.Err = fmt.Errorf("invalid timeout: %w", err)
+		return result
+	}
+
+	time.Sleep(initialDelay)
+
+	for attempt := 1; attempt <= p.Retries+1; attempt++ {
+		if attempt > 1 {
+			time.Sleep(interval)
+		}
+
+		result.Attempts = attempt
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		result.Err = check(ctx)
+		cancel()
+
+		if result.Err == nil {
+			break
+		}
+
+		if opts.Logf != nil {
+			opts.Logf("probe %s failed (attempt %d/%d): %s", result.Name, attempt, p.Retries+1, result.Err)
+		}
+	}
+
+	result.Duration = time.Since(start)
+
+	return result
+}
+
+// Name returns the configured name of the probe, or a description of its
+// target if it has none.
+func Name(p config.ProbeConfig) string {
+	if p.Name != "" {
+		return p.Name
+	}
+
+	switch p.Type {
+	case TypeHTTP:
+		return "http " + p.URL
+	case TypeTCP:
+		return "tcp " + p.Address
+	case TypeCommand:
+		return "command " + p.Command
+	default:
+		return p.Type
+	}
+}
+
+type checkFunc func(ctx context.Context) error
+
+func newCheck(p config.ProbeConfig, opts Options) (checkFunc, error) {
+	switch p.Type {
+	case TypeHTTP:
+		return newHTTPCheck(p)
+	case TypeTCP:
+		if p.Address == "" {
+			return nil, fmt.Errorf("tcp probe requires an address")
+		}
+		return func(ctx context.Context) error {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}, nil
+	case TypeCommand:
+		if p.Command == "" {
+			return nil, fmt.Errorf("command probe requires a command")
+		}
+		return func(ctx context.Context) error {
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", p.Command)
+			cmd.Dir = opts.Dir
+
+			// on timeout the whole group is killed, and the output isn't
+			// waited for when a background child keeps it open
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			cmd.Cancel = func() error {
+				return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			}
+			cmd.WaitDelay = commandWaitDelay
+
+			output, err := cmd.CombinedOutput()
+			if errors.Is(err, exec.ErrWaitDelay) {
+				// the command succeeded, a background child kept the output open
+				err = nil
+			}
+			output = bytes.TrimSpace(output)
+			if err != nil && len(output) > 0 {
+				return fmt.Errorf("%w: %s", err, output)
+			}
+			return err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown probe type: %s", p.Type)
+	}
+}
+
+func newHTTPCheck(p config.ProbeConfig) (checkFunc, error) {
+	if p.URL == "" {
+		return nil, fmt.Errorf("http probe requires an url")
+	}
+
+	method := p.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	status := p.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	var bodyPattern *regexp.Regexp
+	if p.Body != "" {
+		var err error
+		bodyPattern, err = regexp.Compile(p.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body pattern: %w", err)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if p.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{Transport: transport}
+
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, method, p.URL, nil)
+		if err != nil {
+			return err
+		}
+		for key, value := range p.Headers {
+			req.Header.Set(key, value)
+			if http.CanonicalHeaderKey(key) == "Host" {
+				req.Host = value
+			}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != status {
+			return fmt.Errorf("unexpected status code %d, expected %d", resp.StatusCode, status)
+		}
+
+		if bodyPattern != nil {
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response body: %w", err)
+			}
+			if !bodyPattern.Match(body) {
+				return fmt.Errorf("response body does not match %q", bodyPattern)
+			}
+		}
+
+		return nil
+	}, nil
+}
@@ -0,0 +1,443 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/signature"
+	"github.com/serversfordev/deploy/internal/utils"
+)
+
+const (
+	// downloaded artifacts are kept here, relative to the app directory
+	artifactsDir = ".artifacts"
+
+	defaultTimeout = 10 * time.Minute
+)
+
+// Manifest names the artifact to deploy. It is published next to the
+// artifacts by the CI, e.g.
+//
+//	{"version": "1.4.2", "url": "app-1.4.2.tar.gz", "sha256": "9f86d0..."}
+//
+// A relative URL is resolved against the location of the manifest.
+type Manifest struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+	Format  string `json:"format,omitempty"`
+
+	// the detached signature, defaults to the URL of the artifact with
+	// .minisig appended
+	Signature string `json:"signature,omitempty"`
+}
+
+// ArchiveProvider deploys a prebuilt artifact named by a manifest. The
+// version of the manifest is the revision, the artifact is downloaded and
+// verified in Init and extracted into the release in Clone.
+type ArchiveProvider struct {
+	config *config.Config
+	appDir string
+
+	client   *http.Client
+	manifest *Manifest
+	artifact string
+	signedBy string
+}
+
+func New(config *config.Config, appDir string) *ArchiveProvider {
+	return &ArchiveProvider{
+		config: config,
+		appDir: appDir,
+	}
+}
+
+// Init reads the manifest and makes the verified artifact available locally.
+func (p *ArchiveProvider) Init() error {
+	if err := p.initClient(); err != nil {
+		return err
+	}
+
+	manifest, err := p.readManifest()
+	if err != nil {
+		return err
+	}
+
+	if format(p.config.Source.Archive, manifest) == "" {
+		return fmt.Errorf("unknown archive format of %s, configure the format", manifest.URL)
+	}
+
+	artifact, err := p.fetchArtifact(manifest)
+	if err != nil {
+		return err
+	}
+
+	p.signedBy = ""
+	if len(p.config.Source.Signature.PublicKeys) > 0 {
+		key, err := p.verifySignature(manifest, artifact)
+		if err != nil {
+			return err
+		}
+		p.signedBy = key
+	}
+
+	p.manifest = manifest
+	p.artifact = artifact
+
+	return nil
+}
+
+// RemoteRevision reads the version of the manifest, without downloading the
+// artifact.
+func (p *ArchiveProvider) RemoteRevision() (string, error) {
+	if err := p.initClient(); err != nil {
+		return "", err
+	}
+
+	manifest, err := p.readManifest()
+	if err != nil {
+		return "", err
+	}
+
+	return manifest.Version, nil
+}
+
+func (p *ArchiveProvider) GetRevision() (string, error) {
+	if p.manifest == nil {
+		return "", fmt.Errorf("manifest hasn't been read yet")
+	}
+	return p.manifest.Version, nil
+}
+
+func (p *ArchiveProvider) ResolveRef(ref string) (string, error) {
+	return "", fmt.Errorf("failed to resolve ref %s: the archive provider deploys the version of the manifest", ref)
+}
+
+// Clone extracts the artifact into the release.
+func (p *ArchiveProvider) Clone(targetDir string) error {
+	if err := Extract(p.artifact, format(p.config.Source.Archive, p.manifest), targetDir, p.config.Source.Archive.StripComponents); err != nil {
+		return fmt.Errorf("failed to extract artifact: %w", err)
+	}
+
+	return nil
+}
+
+// Metadata reports the artifact of the manifest.
+func (p *ArchiveProvider) Metadata() map[string]string {
+	if p.manifest == nil {
+		return nil
+	}
+
+	metadata := map[string]string{
+		"artifact": p.manifest.URL,
+		"sha256":   p.manifest.SHA256,
+	}
+	if p.signedBy != "" {
+		metadata["signed_by"] = p.signedBy
+	}
+
+	return metadata
+}
+
+func (p *ArchiveProvider) initClient() error {
+	timeout, err := utils.ParseDuration(p.config.Source.Archive.Timeout, defaultTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	p.client = &http.Client{Timeout: timeout}
+
+	return nil
+}
+
+// readManifest reads and validates the manifest. The URL of the artifact is
+// made absolute.
+func (p *ArchiveProvider) readManifest() (*Manifest, error) {
+	location := p.config.Source.Archive.Manifest
+	if location == "" {
+		return nil, fmt.Errorf("archive manifest is not configured")
+	}
+
+	base, err := p.resolveLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.open(base, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer body.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	switch {
+	case manifest.Version == "":
+		return nil, fmt.Errorf("manifest has no version")
+	case manifest.URL == "":
+		return nil, fmt.Errorf("manifest has no url")
+	case len(manifest.SHA256) != sha256.Size*2:
+		return nil, fmt.Errorf("manifest has no valid sha256")
+	}
+	manifest.SHA256 = strings.ToLower(manifest.SHA256)
+
+	artifactURL, err := base.Parse(manifest.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact url: %w", err)
+	}
+	manifest.URL = artifactURL.String()
+
+	return &manifest, nil
+}
+
+// fetchArtifact downloads the artifact into the artifacts directory, resuming
+// an interrupted download, and verifies its checksum. Local artifacts are
+// verified in place.
+func (p *ArchiveProvider) fetchArtifact(manifest *Manifest) (string, error) {
+	u, err := url.Parse(manifest.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid artifact url: %w", err)
+	}
+
+	if u.Scheme == "file" {
+		if err := verifyChecksum(u.Path, manifest.SHA256); err != nil {
+			return "", err
+		}
+		return u.Path, nil
+	}
+
+	dir := filepath.Join(p.appDir, artifactsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create artifacts directory: %w", err)
+	}
+
+	// the checksum names the artifact, so a finished download is reused
+	artifact := filepath.Join(dir, manifest.SHA256+path.Ext(u.Path))
+	if verifyChecksum(artifact, manifest.SHA256) == nil {
+		return artifact, nil
+	}
+
+	partial := artifact + ".partial"
+	if err := p.download(u, partial); err != nil {
+		return "", fmt.Errorf("failed to download artifact: %w", err)
+	}
+
+	if err := verifyChecksum(partial, manifest.SHA256); err != nil {
+		// start over next time
+		os.Remove(partial)
+		return "", err
+	}
+
+	if err := os.Rename(partial, artifact); err != nil {
+		return "", fmt.Errorf("failed to store artifact: %w", err)
+	}
+
+	// only the artifact of the current manifest is kept
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(artifact) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return artifact, nil
+}
+
+// verifySignature checks the detached signature of the artifact against the
+// trusted keys, before anything is extracted. It returns the key that made
+// the signature.
+func (p *ArchiveProvider) verifySignature(manifest *Manifest, artifact string) (string, error) {
+	location := manifest.Signature
+	if location == "" {
+		location = manifest.URL + ".minisig"
+	}
+
+	base, err := url.Parse(manifest.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid artifact url: %w", err)
+	}
+	u, err := base.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature url: %w", err)
+	}
+
+	body, err := p.open(u, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read signature: %w", err)
+	}
+	defer body.Close()
+
+	sig, err := io.ReadAll(io.LimitReader(body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	verified, err := signature.VerifyWithKeys(artifact, sig, p.config.Source.Signature.PublicKeys)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify artifact %s: %w", manifest.URL, err)
+	}
+
+	// the trusted comment binds the signature to the manifest, so an older
+	// signed artifact can't be served as a new version; raw signatures have
+	// no comment and can't be bound
+	if verified.TrustedComment != "" {
+		if file, _ := verified.Field("file"); file != path.Base(base.Path) {
+			return "", fmt.Errorf("failed to verify artifact %s: signed for file %q", manifest.URL, file)
+		}
+		if version, _ := verified.Field("version"); version != manifest.Version {
+			return "", fmt.Errorf("failed to verify artifact %s: signed for version %q, not %q", manifest.URL, version, manifest.Version)
+		}
+	}
+
+	return verified.Key.String(), nil
+}
+
+// download appends to the partial file, starting over when the server doesn't
+// support range requests.
+func (p *ArchiveProvider) download(u *url.URL, partial string) error {
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	body, err := p.open(u, offset)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !body.resumed {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+
+	out, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// body is the content of a file or an HTTP response. resumed reports whether
+// it starts at the requested offset.
+type body struct {
+	io.ReadCloser
+	resumed bool
+}
+
+// open opens a local file or requests a URL, starting at the offset if the
+// server supports it.
+func (p *ArchiveProvider) open(u *url.URL, offset int64) (*body, error) {
+	switch u.Scheme {
+	case "file":
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &body{ReadCloser: f, resumed: true}, nil
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	for name, value := range p.config.Source.Archive.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return &body{ReadCloser: resp.Body, resumed: true}, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial file is already complete, or broken
+		resp.Body.Close()
+		return &body{ReadCloser: io.NopCloser(strings.NewReader("")), resumed: true}, nil
+	case resp.StatusCode == http.StatusOK:
+		return &body{ReadCloser: resp.Body}, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, u.Redacted())
+	}
+}
+
+// resolveLocation turns the manifest location into a URL, plain paths are
+// resolved against the app directory.
+func (p *ArchiveProvider) resolveLocation(location string) (*url.URL, error) {
+	if strings.Contains(location, "://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest url: %w", err)
+		}
+		return u, nil
+	}
+
+	if !filepath.IsAbs(location) {
+		location = filepath.Join(p.appDir, location)
+	}
+
+	return &url.URL{Scheme: "file", Path: filepath.ToSlash(location)}, nil
+}
+
+// format returns the configured format of the artifact, the format of the
+// manifest or the format detected by the extension of the artifact.
+func format(cfg config.ArchiveConfig, manifest *Manifest) string {
+	if cfg.Format != "" {
+		return cfg.Format
+	}
+	if manifest.Format != "" {
+		return manifest.Format
+	}
+	return DetectFormat(manifest.URL)
+}
+
+func verifyChecksum(file, expected string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to read artifact: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to read artifact: %w", err)
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum mismatch for artifact: expected sha256 %s, got %s", expected, actual)
+	}
+
+	return nil
+}
@@ -0,0 +1,328 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// supported archive formats
+const (
+	FormatTar    = "tar"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+	FormatZip    = "zip"
+)
+
+// DetectFormat returns the format of an archive by the extension of its name,
+// or an empty string for an unknown extension.
+func DetectFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return FormatTarZst
+	case strings.HasSuffix(name, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip
+	default:
+		return ""
+	}
+}
+
+// Extract extracts the archive file into the target directory, dropping the
+// given number of leading path components. Entries that would end up outside
+// of the target directory fail the extraction.
+func Extract(file, format, targetDir string, strip int) error {
+	if format == FormatZip {
+		return extractZip(file, targetDir, strip)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return ExtractTar(f, format, targetDir, strip)
+}
+
+// ExtractTar extracts a tar stream, which is compressed according to the
+// format, into the target directory. See Extract.
+func ExtractTar(r io.Reader, format, targetDir string, strip int) error {
+	switch format {
+	case FormatTar:
+	case FormatTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip stream: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	case FormatTarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to read zstd stream: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("unsupported archive format: %q", format)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar archive: %w", err)
+		}
+
+		name, ok, err := entryPath(header.Name, strip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		target, err := safeTarget(targetDir, name)
+		if err != nil {
+			return err
+		}
+		mode := fs.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, dirMode(mode))
+			if err == nil {
+				err = os.Chmod(target, dirMode(mode))
+			}
+		case tar.TypeReg:
+			err = writeFile(target, tr, mode)
+		case tar.TypeSymlink:
+			err = writeSymlink(name, header.Linkname, target)
+		case tar.TypeLink:
+			var linkName string
+			linkName, ok, err = entryPath(header.Linkname, strip)
+			if err == nil && !ok {
+				err = fmt.Errorf("hard link %s points outside of the archive", header.Name)
+			}
+			var source string
+			if err == nil {
+				source, err = safeTarget(targetDir, linkName)
+			}
+			if err == nil {
+				err = writeHardLink(source, target)
+			}
+		default:
+			// devices, fifos and the like aren't part of a release
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+	}
+}
+
+func extractZip(file, targetDir string, strip int) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read zip archive: %w", err)
+	}
+	defer zr.Close()
+
+	for _, entry := range zr.File {
+		name, ok, err := entryPath(entry.Name, strip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		target, err := safeTarget(targetDir, name)
+		if err != nil {
+			return err
+		}
+		mode := entry.Mode()
+
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(target, dirMode(mode.Perm()))
+		case mode&fs.ModeSymlink != 0:
+			err = extractZipSymlink(entry, name, target)
+		case mode.IsRegular():
+			err = extractZipFile(entry, target, mode.Perm())
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", entry.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(entry *zip.File, target string, mode fs.FileMode) error {
+	r, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeFile(target, r, mode)
+}
+
+func extractZipSymlink(entry *zip.File, name, target string) error {
+	r, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	link, err := io.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return err
+	}
+
+	return writeSymlink(name, string(link), target)
+}
+
+// entryPath returns the cleaned relative path of an archive entry without the
+// stripped components. It reports false for entries that are stripped
+// entirely and fails for entries escaping the target directory.
+func entryPath(name string, strip int) (string, bool, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return "", false, fmt.Errorf("archive entry %s has an absolute path", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false, fmt.Errorf("archive entry %s points outside of the target directory", name)
+		}
+	}
+
+	parts := strings.Split(strings.Trim(path.Clean(name), "/"), "/")
+	if len(parts) <= strip || (len(parts) == 1 && parts[0] == ".") {
+		return "", false, nil
+	}
+
+	return filepath.FromSlash(path.Join(parts[strip:]...)), true, nil
+}
+
+// safeTarget returns the path of an entry in the target directory. None of
+// its parents may be a symlink, extracted earlier, which would redirect the
+// entry outside of the target directory.
+func safeTarget(targetDir, name string) (string, error) {
+	dir := targetDir
+	parts := strings.Split(name, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %s is inside of a symlink", name)
+		}
+	}
+
+	return filepath.Join(targetDir, name), nil
+}
+
+// writeFile writes the contents of a regular file, replacing whatever is at
+// the target, so a symlink in the archive can't redirect the write.
+func writeFile(target string, r io.Reader, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// the mode of a new file is subject to the umask
+	return os.Chmod(target, mode)
+}
+
+// writeSymlink creates a symlink, which has to be relative and point inside
+// of the target directory.
+func writeSymlink(name, link, target string) error {
+	if link == "" || path.IsAbs(link) || filepath.IsAbs(link) {
+		return fmt.Errorf("symlink to %q points outside of the target directory", link)
+	}
+	resolved := path.Clean(path.Join(path.Dir(filepath.ToSlash(name)), link))
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("symlink to %q points outside of the target directory", link)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+
+	return os.Symlink(link, target)
+}
+
+func writeHardLink(source, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+
+	return os.Link(source, target)
+}
+
+// removeExisting removes a file or a symlink at the path, directories are
+// kept.
+func removeExisting(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", target)
+	}
+
+	return os.Remove(target)
+}
+
+// dirMode makes sure directories stay writable and searchable for the owner,
+// so their contents can be extracted.
+func dirMode(mode fs.FileMode) fs.FileMode {
+	return mode | 0700
+}
@@ -0,0 +1,249 @@
+package bundle
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/serversfordev/deploy/internal/config"
+)
+
+const (
+	defaultBranch = "main"
+
+	// processed bundles are moved here, relative to the inbox
+	defaultArchiveDir = "processed"
+
+	bundleExt = ".bundle"
+)
+
+// BundleProvider deploys from git bundles dropped into an inbox directory,
+// for hosts without access to the repository. The bundles are fetched into
+// a local repository, so incremental bundles only need to carry the commits
+// since the previous one.
+type BundleProvider struct {
+	config *config.Config
+	appDir string
+
+	metadata map[string]string
+}
+
+func New(config *config.Config, appDir string) *BundleProvider {
+	return &BundleProvider{
+		config: config,
+		appDir: appDir,
+	}
+}
+
+// Init fetches the bundles in the inbox in the order of their names, moves
+// them to the archive and checks out the configured branch. A bundle that
+// fails to verify, e.g. because the bundle with the commits it builds on is
+// missing, stops the deployment and stays in the inbox.
+func (p *BundleProvider) Init() error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git executable not found in PATH: %w", err)
+	}
+
+	p.metadata = make(map[string]string)
+
+	if _, err := os.Stat(p.sourcePath()); os.IsNotExist(err) {
+		if _, err := execGitCommand(p.appDir, "init", "--quiet", p.sourcePath()); err != nil {
+			return fmt.Errorf("failed to create source repository: %w", err)
+		}
+	}
+
+	bundles, err := p.bundles()
+	if err != nil {
+		return err
+	}
+
+	var processed []string
+	for _, bundle := range bundles {
+		name := filepath.Base(bundle)
+
+		if _, err := execGitCommand(p.sourcePath(), "bundle", "verify", "--quiet", bundle); err != nil {
+			return fmt.Errorf("failed to verify bundle %s: %w", name, err)
+		}
+
+		// no pruning, an incremental bundle only carries the refs it updates
+		if _, err := execGitCommand(p.sourcePath(), "fetch", "--force", "--no-tags", bundle,
+			"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"); err != nil {
+			return fmt.Errorf("failed to fetch bundle %s: %w", name, err)
+		}
+
+		if err := p.archive(bundle); err != nil {
+			return fmt.Errorf("failed to archive bundle %s: %w", name, err)
+		}
+		processed = append(processed, name)
+	}
+	if len(processed) > 0 {
+		p.metadata["bundles"] = strings.Join(processed, ", ")
+	}
+
+	remoteBranch := "refs/remotes/origin/" + p.branch()
+	if _, err := execGitCommand(p.sourcePath(), "rev-parse", "--verify", "--quiet", remoteBranch+"^{commit}"); err != nil {
+		return fmt.Errorf("branch %s not found in any bundle, add a bundle containing it to %s", p.branch(), p.inboxPath())
+	}
+
+	if _, err := execGitCommand(p.sourcePath(), "checkout", "--force", "-B", p.branch(), remoteBranch); err != nil {
+		return fmt.Errorf("failed to checkout branch %s: %w", p.branch(), err)
+	}
+
+	if _, err := execGitCommand(p.sourcePath(), "clean", "-ffdx"); err != nil {
+		return fmt.Errorf("failed to clean source repository: %w", err)
+	}
+
+	return nil
+}
+
+// RemoteRevision returns the revision of the branch when the inbox is empty,
+// as there is nothing new to deploy. Pending bundles have to be fetched first.
+func (p *BundleProvider) RemoteRevision() (string, error) {
+	bundles, err := p.bundles()
+	if err != nil {
+		return "", err
+	}
+	if len(bundles) > 0 {
+		return "", nil
+	}
+
+	if _, err := os.Stat(p.sourcePath()); os.IsNotExist(err) {
+		return "", nil
+	}
+
+	revision, err := execGitCommand(p.sourcePath(), "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+p.branch()+"^{commit}")
+	if err != nil {
+		return "", nil
+	}
+
+	return strings.TrimSpace(revision), nil
+}
+
+func (p *BundleProvider) GetRevision() (string, error) {
+	revision, err := execGitCommand(p.sourcePath(), "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(revision), nil
+}
+
+// ResolveRef resolves a branch, a tag or a commit hash of the fetched bundles
+// and checks it out.
+func (p *BundleProvider) ResolveRef(ref string) (string, error) {
+	candidates := []string{
+		"refs/remotes/origin/" + ref,
+		"refs/tags/" + ref,
+		ref,
+	}
+
+	for _, candidate := range candidates {
+		revision, err := execGitCommand(p.sourcePath(), "rev-parse", "--verify", "--quiet", "--end-of-options", candidate+"^{commit}")
+		if err != nil {
+			continue
+		}
+		revision = strings.TrimSpace(revision)
+
+		if _, err := execGitCommand(p.sourcePath(), "checkout", "--force", "--detach", revision); err != nil {
+			return "", fmt.Errorf("failed to checkout ref %s: %w", ref, err)
+		}
+
+		return revision, nil
+	}
+
+	return "", fmt.Errorf("failed to resolve ref %s: not found in any bundle", ref)
+}
+
+func (p *BundleProvider) Clone(targetDir string) error {
+	if _, err := execGitCommand(p.sourcePath(), "checkout-index", "--prefix="+targetDir+"/", "-a", "-f"); err != nil {
+		return fmt.Errorf("failed to copy repository files: %w", err)
+	}
+
+	return nil
+}
+
+// Metadata reports the bundles fetched during Init.
+func (p *BundleProvider) Metadata() map[string]string {
+	return p.metadata
+}
+
+// bundles returns the bundles in the inbox, sorted by name.
+func (p *BundleProvider) bundles() ([]string, error) {
+	if p.config.Source.Bundle.Inbox == "" {
+		return nil, fmt.Errorf("bundle inbox is not configured")
+	}
+
+	entries, err := os.ReadDir(p.inboxPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle inbox: %w", err)
+	}
+
+	var bundles []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), bundleExt) {
+			bundles = append(bundles, filepath.Join(p.inboxPath(), entry.Name()))
+		}
+	}
+	sort.Strings(bundles)
+
+	return bundles, nil
+}
+
+// archive moves a processed bundle out of the inbox.
+func (p *BundleProvider) archive(bundle string) error {
+	archiveDir := p.config.Source.Bundle.Archive
+	if archiveDir == "" {
+		archiveDir = filepath.Join(p.inboxPath(), defaultArchiveDir)
+	} else {
+		archiveDir = p.resolvePath(archiveDir)
+	}
+
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(bundle, filepath.Join(archiveDir, filepath.Base(bundle)))
+}
+
+func (p *BundleProvider) branch() string {
+	if p.config.Source.Bundle.Branch == "" {
+		return defaultBranch
+	}
+	return p.config.Source.Bundle.Branch
+}
+
+func (p *BundleProvider) inboxPath() string {
+	return p.resolvePath(p.config.Source.Bundle.Inbox)
+}
+
+func (p *BundleProvider) sourcePath() string {
+	return filepath.Join(p.appDir, ".git")
+}
+
+func (p *BundleProvider) resolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(p.appDir, path)
+}
+
+func execGitCommand(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// never pick up a repository from a parent directory
+	cmd.Env = append(os.Environ(), "GIT_CEILING_DIRECTORIES="+filepath.Dir(dir), "GIT_TERMINAL_PROMPT=0")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git error: %s. %w", stderr.String(), err)
+	}
+
+	return stdout.String(), nil
+}
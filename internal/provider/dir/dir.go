@@ -0,0 +1,282 @@
+package dir
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+
+	"github.com/serversfordev/deploy/internal/config"
+)
+
+const defaultIgnoreFile = ".deployignore"
+
+// DirProvider deploys the contents of a local directory, e.g. for testing
+// hooks or deploying the output of another build tool. The revision is a
+// hash of the contents, so an unchanged directory isn't deployed again.
+type DirProvider struct {
+	config *config.Config
+	appDir string
+
+	revision string
+}
+
+func New(config *config.Config, appDir string) *DirProvider {
+	return &DirProvider{
+		config: config,
+		appDir: appDir,
+	}
+}
+
+// Init hashes the contents of the source directory, the hash is the
+// revision of the release.
+func (p *DirProvider) Init() error {
+	revision, err := p.hash()
+	if err != nil {
+		return err
+	}
+	p.revision = revision
+
+	return nil
+}
+
+// RemoteRevision hashes the contents of the source directory, which is as
+// cheap as it gets for a local directory.
+func (p *DirProvider) RemoteRevision() (string, error) {
+	return p.hash()
+}
+
+func (p *DirProvider) GetRevision() (string, error) {
+	if p.revision == "" {
+		return "", fmt.Errorf("source directory hasn't been hashed yet")
+	}
+	return p.revision, nil
+}
+
+func (p *DirProvider) ResolveRef(ref string) (string, error) {
+	return "", fmt.Errorf("failed to resolve ref %s: the dir provider has no history", ref)
+}
+
+// Clone copies the source directory into the release, keeping the
+// permissions and the symlinks as they are.
+func (p *DirProvider) Clone(targetDir string) error {
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	var dirs []dirMode
+
+	err := p.walk(func(rel string, path string, info fs.FileInfo) error {
+		target := filepath.Join(targetDir, filepath.FromSlash(rel))
+
+		switch {
+		case info.IsDir():
+			// the permissions are applied last, so read-only directories can
+			// still be filled
+			dirs = append(dirs, dirMode{target, info.Mode().Perm()})
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy source directory: %w", err)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return fmt.Errorf("failed to copy source directory: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Metadata reports the source directory.
+func (p *DirProvider) Metadata() map[string]string {
+	return map[string]string{"path": p.sourcePath()}
+}
+
+// hash returns a hash of the paths, permissions and contents of the files,
+// directories and symlinks in the source directory.
+func (p *DirProvider) hash() (string, error) {
+	h := sha256.New()
+
+	err := p.walk(func(rel string, path string, info fs.FileInfo) error {
+		switch {
+		case info.IsDir():
+			fmt.Fprintf(h, "dir %o %s\n", info.Mode().Perm(), rel)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "symlink %s %s\n", rel, link)
+		default:
+			sum, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "file %o %s %s\n", info.Mode().Perm(), rel, sum)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to hash source directory: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walk calls fn for the directories, regular files and symlinks in the source
+// directory in lexical order, skipping .git and the ignored paths. The
+// relative path uses forward slashes.
+func (p *DirProvider) walk(fn func(rel string, path string, info fs.FileInfo) error) error {
+	if p.config.Source.Dir.Path == "" {
+		return fmt.Errorf("source directory is not configured")
+	}
+	root := p.sourcePath()
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("source directory not found: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("source %s is not a directory", root)
+	}
+
+	matcher, err := p.ignoreMatcher()
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if (d.IsDir() && d.Name() == ".git") || matcher.Match(strings.Split(rel, "/"), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		// sockets, pipes and devices aren't part of a release
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		return fn(rel, path, info)
+	})
+}
+
+// ignoreMatcher reads the ignore file, which uses the .gitignore syntax. A
+// missing ignore file ignores nothing, unless it is configured explicitly.
+func (p *DirProvider) ignoreMatcher() (gitignore.Matcher, error) {
+	ignoreFile := p.config.Source.Dir.IgnoreFile
+	if ignoreFile == "" {
+		ignoreFile = defaultIgnoreFile
+	}
+	if !filepath.IsAbs(ignoreFile) {
+		ignoreFile = filepath.Join(p.sourcePath(), ignoreFile)
+	}
+
+	file, err := os.Open(ignoreFile)
+	if os.IsNotExist(err) && p.config.Source.Dir.IgnoreFile == "" {
+		return gitignore.NewMatcher(nil), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	defer file.Close()
+
+	var patterns []gitignore.Pattern
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, nil))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+
+	return gitignore.NewMatcher(patterns), nil
+}
+
+func (p *DirProvider) sourcePath() string {
+	path := p.config.Source.Dir.Path
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(p.appDir, path)
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// the mode of a new file is subject to the umask
+	return os.Chmod(dst, perm)
+}
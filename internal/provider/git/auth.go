@@ -0,0 +1,179 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/serversfordev/deploy/internal/config"
+)
+
+const (
+	// git runs the deploy binary itself as GIT_ASKPASS program, these
+	// variables tell it to answer the prompt instead of running the CLI
+	askpassEnv         = "DEPLOY_GIT_ASKPASS"
+	askpassUsernameEnv = "DEPLOY_GIT_USERNAME"
+	askpassTokenEnv    = "DEPLOY_GIT_TOKEN"
+
+	defaultUsername = "x-access-token"
+
+	// the pinned host key is written next to the config
+	knownHostsFileName = "known_hosts"
+)
+
+// IsAskpass reports whether the process was started by git to ask for
+// credentials.
+func IsAskpass() bool {
+	return os.Getenv(askpassEnv) == "1"
+}
+
+// Askpass answers the prompt git passes as the first argument with the
+// username or the token of the app.
+func Askpass(args []string) {
+	prompt := ""
+	if len(args) > 1 {
+		prompt = args[1]
+	}
+
+	if strings.HasPrefix(prompt, "Username") {
+		fmt.Println(os.Getenv(askpassUsernameEnv))
+		return
+	}
+	fmt.Println(os.Getenv(askpassTokenEnv))
+}
+
+// authEnv returns the environment git runs with. Prompts are disabled, so a
+// missing credential fails instead of waiting for input.
+func (p *GitProvider) authEnv() []string {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+
+	if p.sshCommand != "" {
+		env = append(env, "GIT_SSH_COMMAND="+p.sshCommand)
+	}
+
+	if p.token != "" {
+		env = append(env,
+			"GIT_ASKPASS="+p.askpass,
+			askpassEnv+"=1",
+			askpassUsernameEnv+"="+p.username,
+			askpassTokenEnv+"="+p.token,
+		)
+	}
+
+	return env
+}
+
+// authArgs returns the options passed to every git command.
+func (p *GitProvider) authArgs() []string {
+	helper := p.config.Source.Git.Auth.CredentialHelper
+	if helper == "" {
+		return nil
+	}
+
+	// the empty value resets the helpers configured for the user
+	return []string{"-c", "credential.helper=", "-c", "credential.helper=" + helper}
+}
+
+// credentials are the resolved authentication options of the app.
+type credentials struct {
+	username   string
+	token      string
+	sshKey     string
+	knownHosts string
+}
+
+// loadCredentials resolves the configured credentials. It fails if a
+// configured credential isn't available.
+func loadCredentials(appDir string, auth config.GitAuthConfig) (*credentials, error) {
+	creds := &credentials{username: auth.Username}
+	if creds.username == "" {
+		creds.username = defaultUsername
+	}
+
+	switch {
+	case auth.TokenEnv != "":
+		creds.token = os.Getenv(auth.TokenEnv)
+		if creds.token == "" {
+			return nil, fmt.Errorf("token environment variable %s is not set", auth.TokenEnv)
+		}
+	case auth.TokenFile != "":
+		data, err := os.ReadFile(resolvePath(appDir, auth.TokenFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file: %w", err)
+		}
+		creds.token = strings.TrimSpace(string(data))
+		if creds.token == "" {
+			return nil, fmt.Errorf("token file %s is empty", auth.TokenFile)
+		}
+	}
+
+	if auth.SSHKey != "" {
+		creds.sshKey = resolvePath(appDir, auth.SSHKey)
+		if _, err := os.Stat(creds.sshKey); err != nil {
+			return nil, fmt.Errorf("ssh key not found: %w", err)
+		}
+	}
+
+	if auth.HostKey != "" {
+		creds.knownHosts = filepath.Join(appDir, knownHostsFileName)
+		if err := os.WriteFile(creds.knownHosts, []byte(strings.TrimSpace(auth.HostKey)+"\n"), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write pinned host key: %w", err)
+		}
+	} else if auth.KnownHosts != "" {
+		creds.knownHosts = resolvePath(appDir, auth.KnownHosts)
+		if _, err := os.Stat(creds.knownHosts); err != nil {
+			return nil, fmt.Errorf("known hosts file not found: %w", err)
+		}
+	}
+
+	return creds, nil
+}
+
+// initAuth resolves the configured credentials into the environment of the
+// git commands.
+func (p *GitProvider) initAuth() error {
+	creds, err := loadCredentials(p.appDir, p.config.Source.Git.Auth)
+	if err != nil {
+		return err
+	}
+
+	p.username = creds.username
+	p.token = creds.token
+	if p.token != "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to resolve the askpass program: %w", err)
+		}
+		p.askpass = executable
+	}
+
+	p.sshCommand = ""
+	if creds.sshKey == "" && creds.knownHosts == "" {
+		return nil
+	}
+
+	// never ask for a passphrase or to confirm an unknown host
+	options := []string{"ssh", "-o", "BatchMode=yes"}
+	if creds.sshKey != "" {
+		options = append(options, "-i", shellQuote(creds.sshKey), "-o", "IdentitiesOnly=yes")
+	}
+	if creds.knownHosts != "" {
+		options = append(options, "-o", "UserKnownHostsFile="+shellQuote(creds.knownHosts), "-o", "StrictHostKeyChecking=yes")
+	}
+	p.sshCommand = strings.Join(options, " ")
+
+	return nil
+}
+
+func resolvePath(appDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(appDir, path)
+}
+
+// shellQuote quotes the value for GIT_SSH_COMMAND, which is run by the shell.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
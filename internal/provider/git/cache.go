@@ -0,0 +1,262 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/lock"
+)
+
+// every cache is a bare repository with a lock file next to it, the
+// modification time of the lock file is the last time the cache was used.
+// The source checkouts linked to the cache are listed in the cache.
+const (
+	cacheSuffix     = ".git"
+	cacheLockSuffix = ".lock"
+	cacheCheckouts  = "deploy-checkouts"
+)
+
+// cachePath returns the cache of the repository under the cache directory.
+// Apps deploying the same repository share it, whatever their branch.
+func cachePath(cacheDir, repo string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSuffix(strings.TrimSpace(repo), "/")))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+cacheSuffix)
+}
+
+// updateCache fetches every branch and tag of the repository into the shared
+// cache, which the source checkout then fetches from. The cache is locked, so
+// apps deploying the same repository at the same time take turns.
+func (p *GitProvider) updateCache() error {
+	if err := os.MkdirAll(filepath.Dir(p.cachePath), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	unlock, err := lock.Wait(p.cachePath + cacheLockSuffix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := p.execGitCommand(p.cachePath, "rev-parse", "--git-dir"); err != nil {
+		if err := os.RemoveAll(p.cachePath); err != nil {
+			return fmt.Errorf("failed to remove broken cache: %w", err)
+		}
+		if _, err := p.execGitCommand(filepath.Dir(p.cachePath), "init", "--bare", "--quiet", p.cachePath); err != nil {
+			return fmt.Errorf("failed to create cache: %w", err)
+		}
+	}
+
+	if _, err := p.remoteCommand(p.cachePath, func(url string) []string {
+		return []string{"fetch", "--prune", "--force", url, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+	}); err != nil {
+		return fmt.Errorf("failed to update cache: %w", err)
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(p.cachePath+cacheLockSuffix, now, now); err != nil {
+		return fmt.Errorf("failed to update cache: %w", err)
+	}
+
+	return nil
+}
+
+// useCache takes a shared lock on the cache for as long as the source
+// checkout reads objects from it, so GC doesn't collect the cache meanwhile.
+// Without a cache it does nothing.
+func (p *GitProvider) useCache() (func() error, error) {
+	if p.cachePath == "" {
+		return func() error { return nil }, nil
+	}
+
+	return lock.WaitShared(p.cachePath + cacheLockSuffix)
+}
+
+// linkCache makes the objects of the cache available to the source checkout
+// through its alternates, so fetching from the cache doesn't copy them. The
+// checkout is registered in the cache, which GC keeps as long as the checkout
+// links to it.
+func (p *GitProvider) linkCache() error {
+	checkouts := filepath.Join(p.cachePath, cacheCheckouts)
+	registered, err := readLines(checkouts)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(registered, p.sourcePath()) {
+		// appends of a single line don't interleave with other apps
+		f, err := os.OpenFile(checkouts, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString(p.sourcePath() + "\n")
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	alternates := alternatesPath(p.sourcePath())
+	objects := filepath.Join(p.cachePath, "objects")
+
+	linked, err := readLines(alternates)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(linked, objects) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(alternates), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(alternates, []byte(strings.Join(append(linked, objects), "\n")+"\n"), 0644)
+}
+
+// linkedCheckouts returns the registered source checkouts that still read
+// objects from the cache.
+func linkedCheckouts(path string) ([]string, error) {
+	registered, err := readLines(filepath.Join(path, cacheCheckouts))
+	if err != nil {
+		return nil, err
+	}
+
+	objects := filepath.Join(path, "objects")
+	var checkouts []string
+	for _, checkout := range registered {
+		linked, err := readLines(alternatesPath(checkout))
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(linked, objects) {
+			checkouts = append(checkouts, checkout)
+		}
+	}
+
+	return checkouts, nil
+}
+
+func alternatesPath(sourcePath string) string {
+	return filepath.Join(sourcePath, ".git", "objects", "info", "alternates")
+}
+
+// readLines returns the non-empty lines of the file, none if it doesn't
+// exist.
+func readLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// GCResult reports what GC did to the caches under a cache directory.
+type GCResult struct {
+	Collected []string
+	Removed   []string
+	// Kept are unused or broken caches that source checkouts still link to
+	Kept []string
+}
+
+// GC removes the caches that haven't been used for maxAge and packs the
+// others. Objects are never pruned and caches that source checkouts link to
+// are never removed, as the checkouts read their objects from the cache. Each
+// cache is locked while it is collected, deployments reading from the cache
+// hold a shared lock.
+func GC(cacheDir string, maxAge time.Duration) (*GCResult, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	// the caches don't need any credentials
+	p := New(&config.Config{}, cacheDir)
+
+	result := &GCResult{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), cacheSuffix) {
+			continue
+		}
+		path := filepath.Join(cacheDir, entry.Name())
+
+		outcome, err := p.collectCache(path, maxAge)
+		if err != nil {
+			return result, fmt.Errorf("failed to collect %s: %w", path, err)
+		}
+
+		switch outcome {
+		case cacheRemoved:
+			result.Removed = append(result.Removed, path)
+		case cacheKept:
+			result.Kept = append(result.Kept, path)
+		default:
+			result.Collected = append(result.Collected, path)
+		}
+	}
+
+	return result, nil
+}
+
+// outcomes of collectCache
+const (
+	cacheCollected = iota
+	cacheRemoved
+	cacheKept
+)
+
+// collectCache removes the cache if it is unused or broken and no source
+// checkout links to it, otherwise it runs git gc on it if it isn't broken.
+func (p *GitProvider) collectCache(path string, maxAge time.Duration) (int, error) {
+	unlock, err := lock.Wait(path + cacheLockSuffix)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	info, err := os.Stat(path + cacheLockSuffix)
+	if err != nil {
+		return 0, err
+	}
+
+	unused := maxAge > 0 && time.Since(info.ModTime()) > maxAge
+	_, fsckErr := p.execGitCommand(path, "fsck", "--connectivity-only", "--no-dangling")
+	if !unused && fsckErr == nil {
+		// unreachable objects may still be used by a checkout
+		if _, err := p.execGitCommand(path, "gc", "--quiet", "--prune=never"); err != nil {
+			return 0, err
+		}
+		return cacheCollected, nil
+	}
+
+	checkouts, err := linkedCheckouts(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(checkouts) > 0 {
+		return cacheKept, nil
+	}
+
+	// the lock file stays, other processes may be waiting on it
+	if err := os.RemoveAll(path); err != nil {
+		return 0, err
+	}
+
+	return cacheRemoved, nil
+}
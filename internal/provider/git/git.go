@@ -2,7 +2,9 @@ package git
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -13,6 +15,33 @@ import (
 type GitProvider struct {
 	config *config.Config
 	appDir string
+
+	metadata map[string]string
+
+	// the shared object cache of the repository, see updateCache
+	cachePath string
+
+	// resolved credentials, see initAuth
+	username   string
+	token      string
+	askpass    string
+	sshCommand string
+}
+
+// the commits of the submodules are reported as "submodule <path>"
+const submoduleMetadataPrefix = "submodule "
+
+// corruptedError is returned when the source checkout can't be used anymore.
+type corruptedError struct {
+	err error
+}
+
+func (e *corruptedError) Error() string {
+	return fmt.Sprintf("corrupted source checkout: %s", e.err)
+}
+
+func (e *corruptedError) Unwrap() error {
+	return e.err
 }
 
 func New(config *config.Config, appDir string) *GitProvider {
@@ -28,39 +57,498 @@ func (p *GitProvider) Init() error {
 		return fmt.Errorf("git executable not found in PATH: %w", err)
 	}
 
-	if _, err := execGitCommand(p.sourcePath(), "rev-parse", "--git-dir"); err != nil {
-		args := []string{"clone", p.config.Source.Git.Repo, p.sourcePath()}
-		if _, err := execGitCommand(p.appDir, args...); err != nil {
+	if p.config.Source.Git.LFS {
+		if _, err := exec.LookPath("git-lfs"); err != nil {
+			return fmt.Errorf("lfs is enabled but git-lfs is not installed: %w", err)
+		}
+	}
+
+	if err := p.initAuth(); err != nil {
+		return fmt.Errorf("failed to configure authentication: %w", err)
+	}
+
+	p.metadata = make(map[string]string)
+
+	p.cachePath = ""
+	if p.config.Source.Git.Cache != "" {
+		p.cachePath = cachePath(resolvePath(p.appDir, p.config.Source.Git.Cache), p.config.Source.Git.Repo)
+		if err := p.updateCache(); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := p.useCache()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = p.sync()
+	var corrupted *corruptedError
+	if errors.As(err, &corrupted) {
+		// the source checkout is disposable, start over from a fresh clone
+		p.metadata["recloned"] = corrupted.Error()
+		if err := os.RemoveAll(p.sourcePath()); err != nil {
+			return fmt.Errorf("failed to remove corrupted source checkout: %w", err)
+		}
+
+		err = p.sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.config.Source.Git.Tags != "" {
+		if err := p.checkoutTag(); err != nil {
+			return err
+		}
+	}
+
+	return p.updateWorkingTree()
+}
+
+// updateWorkingTree brings the submodules and the LFS objects in line with
+// the checked out revision and records the commits of the submodules.
+func (p *GitProvider) updateWorkingTree() error {
+	for key := range p.metadata {
+		if strings.HasPrefix(key, submoduleMetadataPrefix) {
+			delete(p.metadata, key)
+		}
+	}
+
+	if p.config.Source.Git.Submodules {
+		if _, err := p.execGitCommand(p.sourcePath(), "submodule", "sync", "--recursive"); err != nil {
+			return fmt.Errorf("failed to sync submodules: %w", err)
+		}
+
+		args := []string{"submodule", "update", "--init", "--recursive", "--force"}
+		if _, err := p.execGitCommand(p.sourcePath(), args...); err != nil {
+			return fmt.Errorf("failed to update submodules: %w", err)
+		}
+
+		submodules, err := p.submodules()
+		if err != nil {
+			return err
+		}
+		for path, revision := range submodules {
+			p.metadata[submoduleMetadataPrefix+path] = revision
+		}
+	}
+
+	if p.config.Source.Git.LFS {
+		// the filter makes checkout-index export the objects instead of the
+		// pointer files
+		if _, err := p.execGitCommand(p.sourcePath(), "lfs", "install", "--local"); err != nil {
+			return fmt.Errorf("failed to install git lfs: %w", err)
+		}
+		if _, err := p.execGitCommand(p.sourcePath(), "lfs", "pull"); err != nil {
+			return fmt.Errorf("failed to pull lfs objects: %w", err)
+		}
+
+		if p.config.Source.Git.Submodules {
+			args := []string{"submodule", "foreach", "--recursive", "git lfs install --local && git lfs pull"}
+			if _, err := p.execGitCommand(p.sourcePath(), args...); err != nil {
+				return fmt.Errorf("failed to pull lfs objects of submodules: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// submodules returns the checked out commit of each submodule by its path.
+func (p *GitProvider) submodules() (map[string]string, error) {
+	output, err := p.execGitCommand(p.sourcePath(), "submodule", "status", "--recursive")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get submodule status: %w", err)
+	}
+
+	submodules := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		// " <commit> <path> (<describe>)", prefixed with -, + or U instead of
+		// the space if the submodule isn't in sync
+		fields := strings.Fields(strings.TrimLeft(line, " -+U"))
+		if len(fields) < 2 {
+			continue
+		}
+		submodules[fields[1]] = fields[0]
+	}
+
+	return submodules, nil
+}
+
+// checkoutTag checks out the highest tag matching the configured tags, so
+// GetRevision and Clone use it instead of the tip of the branch.
+func (p *GitProvider) checkoutTag() error {
+	if _, err := p.fetchCommand(p.sourcePath(), func(url string) []string {
+		return []string{"fetch", "--force", "--prune", url, "+refs/tags/*:refs/tags/*"}
+	}); err != nil {
+		return fmt.Errorf("failed to fetch tags: %w", err)
+	}
+
+	output, err := p.execGitCommand(p.sourcePath(), "tag", "--list")
+	if err != nil {
+		return fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	tag, err := selectTag(strings.Fields(output), p.config.Source.Git.Tags, p.config.Source.Git.Prerelease)
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.execGitCommand(p.sourcePath(), "checkout", "--force", "--detach", "refs/tags/"+tag); err != nil {
+		return fmt.Errorf("failed to checkout tag %s: %w", tag, err)
+	}
+	p.metadata["tag"] = tag
+
+	return nil
+}
+
+// RemoteRevision asks the remote for the tip of the branch, or for the commit
+// of the tag matching the configured tags.
+func (p *GitProvider) RemoteRevision() (string, error) {
+	if err := p.initAuth(); err != nil {
+		return "", fmt.Errorf("failed to configure authentication: %w", err)
+	}
+
+	if p.config.Source.Git.Tags != "" {
+		return p.remoteTagRevision()
+	}
+
+	output, err := p.remoteCommand(p.appDir, func(url string) []string {
+		return []string{"ls-remote", "--", url, "refs/heads/" + p.config.Source.Git.Branch}
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote refs: %w", err)
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("branch %s not found on the remote", p.config.Source.Git.Branch)
+	}
+
+	return fields[0], nil
+}
+
+// remoteTagRevision returns the commit of the highest remote tag matching the
+// configured tags.
+func (p *GitProvider) remoteTagRevision() (string, error) {
+	output, err := p.remoteCommand(p.appDir, func(url string) []string {
+		return []string{"ls-remote", "--tags", "--", url}
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote tags: %w", err)
+	}
+
+	// "<hash>\t<ref>" per line
+	refs := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	_, revision, err := selectRemoteTag(refs, p.config.Source.Git.Tags, p.config.Source.Git.Prerelease)
+	return revision, err
+}
+
+// Metadata reports what happened to the source checkout during Init, such as
+// a re-clone or a rewritten history.
+func (p *GitProvider) Metadata() map[string]string {
+	return p.metadata
+}
+
+// sync brings the source checkout to the tip of the remote branch, no matter
+// what happened to the local or the remote history. Errors caused by a broken
+// checkout are returned as corruptedError.
+func (p *GitProvider) sync() error {
+	branch := p.config.Source.Git.Branch
+	remoteBranch := "refs/remotes/origin/" + branch
+
+	// the revision of the remote branch as of the previous run
+	var previousRevision string
+
+	if _, err := os.Stat(p.sourcePath()); os.IsNotExist(err) && p.cachePath != "" {
+		// the objects are fetched from the cache below
+		if _, err := p.execGitCommand(p.appDir, "init", "--quiet", p.sourcePath()); err != nil {
+			return fmt.Errorf("failed to create source checkout: %w", err)
+		}
+		if _, err := p.execGitCommand(p.sourcePath(), "remote", "add", "origin", p.config.Source.Git.Repo); err != nil {
+			return &corruptedError{err}
+		}
+	} else if os.IsNotExist(err) {
+		if _, err := p.remoteCommand(p.appDir, func(url string) []string {
+			return []string{"clone", "--no-checkout", url, p.sourcePath()}
+		}); err != nil {
 			return fmt.Errorf("failed to clone repository: %w", err)
 		}
+	} else {
+		if _, err := p.execGitCommand(p.sourcePath(), "rev-parse", "--git-dir"); err != nil {
+			return &corruptedError{err}
+		}
+
+		previousRevision, _ = p.execGitCommand(p.sourcePath(), "rev-parse", "--verify", "--quiet", remoteBranch+"^{commit}")
+		previousRevision = strings.TrimSpace(previousRevision)
+	}
+
+	if _, err := p.execGitCommand(p.sourcePath(), "remote", "set-url", "origin", p.config.Source.Git.Repo); err != nil {
+		return &corruptedError{err}
 	}
 
-	args := []string{"checkout", p.config.Source.Git.Branch}
-	if _, err := execGitCommand(p.sourcePath(), args...); err != nil {
-		return fmt.Errorf("failed to checkout branch: %w", err)
+	if p.cachePath != "" {
+		if err := p.linkCache(); err != nil {
+			return fmt.Errorf("failed to link cache: %w", err)
+		}
 	}
 
-	args = []string{"pull", "origin", p.config.Source.Git.Branch}
-	if _, err := execGitCommand(p.sourcePath(), args...); err != nil {
-		return fmt.Errorf("failed to pull latest changes: %w", err)
+	if _, err := p.fetchCommand(p.sourcePath(), func(url string) []string {
+		return []string{"fetch", "--prune", url, "+refs/heads/" + branch + ":" + remoteBranch}
+	}); err != nil {
+		// tell a broken checkout from an unreachable remote
+		if _, fsckErr := p.execGitCommand(p.sourcePath(), "fsck", "--connectivity-only", "--no-dangling"); fsckErr != nil {
+			return &corruptedError{fsckErr}
+		}
+		return fmt.Errorf("failed to fetch latest changes: %w", err)
+	}
+
+	if previousRevision != "" {
+		revision, err := p.execGitCommand(p.sourcePath(), "rev-parse", "--verify", remoteBranch+"^{commit}")
+		if err != nil {
+			return &corruptedError{err}
+		}
+		revision = strings.TrimSpace(revision)
+
+		// exit code 1 means the previous revision is no longer part of the
+		// branch, any other failure is an unknown previous revision
+		_, err = p.execGitCommand(p.sourcePath(), "merge-base", "--is-ancestor", previousRevision, revision)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			p.metadata["history_rewritten"] = fmt.Sprintf("%s is no longer an ancestor of %s", previousRevision, revision)
+		}
+	}
+
+	// only the deployed subtree is needed in the working tree, older versions
+	// of git without sparse checkout simply check out everything
+	if p.config.Source.Git.Path != "" {
+		_, _ = p.execGitCommand(p.sourcePath(), "sparse-checkout", "set", "--", p.config.Source.Git.Path)
+	} else if sparse, _ := p.execGitCommand(p.sourcePath(), "config", "--bool", "core.sparseCheckout"); strings.TrimSpace(sparse) == "true" {
+		if _, err := p.execGitCommand(p.sourcePath(), "sparse-checkout", "disable"); err != nil {
+			return &corruptedError{err}
+		}
+	}
+
+	// equivalent to a hard reset to the remote branch, which also works when
+	// the branch changed in the config
+	if _, err := p.execGitCommand(p.sourcePath(), "checkout", "--force", "-B", branch, remoteBranch); err != nil {
+		return &corruptedError{err}
+	}
+
+	if _, err := p.execGitCommand(p.sourcePath(), "clean", "-ffdx"); err != nil {
+		return &corruptedError{err}
 	}
 
 	return nil
 }
 
+// ResolveRef resolves a branch, a tag or a commit hash to a commit and checks
+// it out in the source checkout. Refs that aren't available locally are
+// fetched from the remote.
+func (p *GitProvider) ResolveRef(ref string) (string, error) {
+	unlock, err := p.useCache()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// refs are passed to git, they must not be taken for options
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid ref %q", ref)
+	}
+
+	// tags and the branch of the same name may have moved since the last run.
+	// A ref that doesn't name a branch fails the second fetch, so the errors
+	// only count if the ref can't be resolved at all
+	var fetchErrs []error
+	if _, err := p.fetchCommand(p.sourcePath(), func(url string) []string {
+		return []string{"fetch", "--force", url, "+refs/tags/*:refs/tags/*"}
+	}); err != nil {
+		fetchErrs = append(fetchErrs, fmt.Errorf("failed to fetch tags: %w", err))
+		p.metadata["ref_fetch_error"] = err.Error()
+	}
+	if _, err := p.fetchCommand(p.sourcePath(), func(url string) []string {
+		return []string{"fetch", "--force", url, "+refs/heads/" + ref + ":refs/remotes/origin/" + ref}
+	}); err != nil {
+		fetchErrs = append(fetchErrs, fmt.Errorf("failed to fetch branch: %w", err))
+	}
+
+	candidates := []string{
+		"refs/remotes/origin/" + ref,
+		"refs/tags/" + ref,
+		ref,
+	}
+
+	revision, err := p.resolveCommit(candidates...)
+	if err != nil {
+		// a commit that isn't part of any fetched branch or tag
+		if _, fetchErr := p.remoteCommand(p.sourcePath(), func(url string) []string {
+			return []string{"fetch", "--end-of-options", url, ref}
+		}); fetchErr != nil {
+			fetchErrs = append(fetchErrs, fmt.Errorf("failed to fetch commit: %w", fetchErr))
+			return "", fmt.Errorf("failed to resolve ref %s: %w: %w", ref, err, errors.Join(fetchErrs...))
+		}
+		if revision, err = p.resolveCommit("FETCH_HEAD"); err != nil {
+			return "", fmt.Errorf("failed to resolve ref %s: %w", ref, err)
+		}
+	}
+
+	if _, err := p.execGitCommand(p.sourcePath(), "checkout", "--force", "--detach", revision); err != nil {
+		return "", fmt.Errorf("failed to checkout ref %s: %w", ref, err)
+	}
+
+	if err := p.updateWorkingTree(); err != nil {
+		return "", err
+	}
+
+	return revision, nil
+}
+
+// resolveCommit returns the commit of the first candidate that exists.
+func (p *GitProvider) resolveCommit(candidates ...string) (string, error) {
+	var err error
+	for _, candidate := range candidates {
+		var revision string
+		revision, err = p.execGitCommand(p.sourcePath(), "rev-parse", "--verify", "--quiet", "--end-of-options", candidate+"^{commit}")
+		if err == nil {
+			return strings.TrimSpace(revision), nil
+		}
+	}
+
+	return "", fmt.Errorf("no such commit")
+}
+
 func (p *GitProvider) Clone(targetDir string) error {
+	unlock, err := p.useCache()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if p.config.Source.Git.Path != "" {
+		return p.cloneSubtree(targetDir)
+	}
+
 	// Use checkout-index to copy files into target directory
 	args := []string{"checkout-index", "--prefix=" + targetDir + "/", "-a", "-f"}
-	_, err := execGitCommand(p.sourcePath(), args...)
-	if err != nil {
+	if _, err := p.execGitCommand(p.sourcePath(), args...); err != nil {
 		return fmt.Errorf("failed to copy repository files: %w", err)
 	}
 
+	return p.cloneSubmodules("", targetDir)
+}
+
+// cloneSubmodules copies the files of the submodules under the path into the
+// target directory, which holds the contents of that path.
+func (p *GitProvider) cloneSubmodules(path, targetDir string) error {
+	if !p.config.Source.Git.Submodules {
+		return nil
+	}
+
+	submodules, err := p.submodules()
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+
+	for submodulePath := range submodules {
+		if !strings.HasPrefix(submodulePath, prefix) {
+			continue
+		}
+
+		target := filepath.Join(targetDir, strings.TrimPrefix(submodulePath, prefix))
+		args := []string{"checkout-index", "--prefix=" + target + "/", "-a", "-f"}
+		if _, err := p.execGitCommand(filepath.Join(p.sourcePath(), submodulePath), args...); err != nil {
+			return fmt.Errorf("failed to copy files of submodule %s: %w", submodulePath, err)
+		}
+	}
+
 	return nil
 }
 
+// cloneSubtree copies the files under the configured path into the target
+// directory. The subtree is read into a temporary index, so it doesn't
+// depend on what the sparse checkout left in the working tree.
+func (p *GitProvider) cloneSubtree(targetDir string) error {
+	index, err := os.CreateTemp("", "deploy-index-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary index: %w", err)
+	}
+	index.Close()
+	defer os.Remove(index.Name())
+
+	env := []string{"GIT_INDEX_FILE=" + index.Name()}
+	tree := "HEAD:" + strings.Trim(p.config.Source.Git.Path, "/")
+
+	if _, err := p.execGitCommandWithEnv(p.sourcePath(), env, "read-tree", tree); err != nil {
+		return fmt.Errorf("failed to read path %s: %w", p.config.Source.Git.Path, err)
+	}
+
+	args := []string{"checkout-index", "--prefix=" + targetDir + "/", "-a", "-f"}
+	if _, err := p.execGitCommandWithEnv(p.sourcePath(), env, args...); err != nil {
+		return fmt.Errorf("failed to copy repository files: %w", err)
+	}
+
+	return p.cloneSubmodules(strings.Trim(p.config.Source.Git.Path, "/"), targetDir)
+}
+
+// Changed reports whether any of the watched paths differ between the two
+// revisions. Without watched paths, any change of the revision counts.
+func (p *GitProvider) Changed(fromRevision, toRevision string) (bool, error) {
+	paths := p.config.Source.Git.WatchPaths
+	if len(paths) == 0 && p.config.Source.Git.Path != "" {
+		paths = []string{p.config.Source.Git.Path}
+	}
+	if len(paths) == 0 {
+		return fromRevision != toRevision, nil
+	}
+
+	unlock, err := p.useCache()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	// the previous revision is gone, e.g. after a history rewrite
+	if _, err := p.execGitCommand(p.sourcePath(), "cat-file", "-e", fromRevision+"^{commit}"); err != nil {
+		return true, nil
+	}
+
+	for _, path := range paths {
+		path = strings.Trim(path, "/")
+		if p.treeHash(fromRevision, path) != p.treeHash(toRevision, path) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// treeHash returns the hash of the object at the path in the revision, or an
+// empty string if the path doesn't exist there.
+func (p *GitProvider) treeHash(revision, path string) string {
+	hash, err := p.execGitCommand(p.sourcePath(), "rev-parse", "--verify", "--quiet", revision+":"+path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(hash)
+}
+
 func (p *GitProvider) GetRevision() (string, error) {
-	currentHash, err := execGitCommand(p.sourcePath(), "rev-parse", "HEAD")
+	currentHash, err := p.execGitCommand(p.sourcePath(), "rev-parse", "HEAD")
 	if err != nil {
 		return "", err
 	}
@@ -73,9 +561,50 @@ func (p *GitProvider) sourcePath() string {
 	return filepath.Join(p.appDir, ".git")
 }
 
-func execGitCommand(dir string, args ...string) (string, error) {
-	cmd := exec.Command("git", args...)
+// remoteCommand runs a git command talking to the remote against the
+// repository and its mirrors, see withRemotes. The arguments are built for
+// the URL of each remote.
+func (p *GitProvider) remoteCommand(dir string, args func(url string) []string) (string, error) {
+	var output string
+	url, err := withRemotes(p.config.Source.Git, func(url string) error {
+		var err error
+		output, err = p.execGitCommand(dir, args(url)...)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if url != p.config.Source.Git.Repo && p.metadata != nil {
+		p.metadata["mirror"] = url
+	}
+
+	return output, nil
+}
+
+// fetchCommand runs a git command fetching into the source checkout. With a
+// cache it fetches from the cache, which Init brought up to date, otherwise
+// from the remote.
+func (p *GitProvider) fetchCommand(dir string, args func(url string) []string) (string, error) {
+	if p.cachePath != "" {
+		return p.execGitCommand(dir, args(p.cachePath)...)
+	}
+
+	return p.remoteCommand(dir, args)
+}
+
+func (p *GitProvider) execGitCommand(dir string, args ...string) (string, error) {
+	return p.execGitCommandWithEnv(dir, nil, args...)
+}
+
+func (p *GitProvider) execGitCommandWithEnv(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", append(p.authArgs(), args...)...)
 	cmd.Dir = dir
+	// never pick up a repository from a parent directory, e.g. when the
+	// source checkout lost its .git directory
+	cmd.Env = append(os.Environ(), "GIT_CEILING_DIRECTORIES="+filepath.Dir(dir))
+	cmd.Env = append(cmd.Env, p.authEnv()...)
+	cmd.Env = append(cmd.Env, env...)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -0,0 +1,640 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	gogit "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	"github.com/serversfordev/deploy/internal/config"
+)
+
+// localProtocol is the scheme local repositories are fetched with by the
+// native backend, which serves them in-process instead of running
+// git-upload-pack. The file scheme of go-git is left as it is for anyone else
+// in the process.
+const localProtocol = "deploy-file"
+
+func init() {
+	client.InstallProtocol(localProtocol, server.NewServer(localLoader{}))
+}
+
+// transportURL returns the url the native backend fetches the repository
+// from, local repositories are served by localProtocol.
+func transportURL(repo string) string {
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil || endpoint.Protocol != "file" {
+		return repo
+	}
+
+	path, err := filepath.Abs(endpoint.Path)
+	if err != nil {
+		return repo
+	}
+
+	return (&url.URL{Scheme: localProtocol, Path: path}).String()
+}
+
+// localLoader loads bare repositories and the .git directory of non-bare
+// ones, the default loader of go-git only supports bare repositories.
+type localLoader struct{}
+
+func (localLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	fs := osfs.New(ep.Path)
+	if info, err := fs.Stat(gogit.GitDirName); err == nil && info.IsDir() {
+		if fs, err = fs.Chroot(gogit.GitDirName); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := fs.Stat("config"); err != nil {
+		return nil, transport.ErrRepositoryNotFound
+	}
+
+	return filesystem.NewStorage(fs, cache.NewObjectLRUDefault()), nil
+}
+
+// NativeProvider is a git provider built on a pure Go implementation of git,
+// so it doesn't need the git executable. It uses the same source checkout
+// as GitProvider.
+type NativeProvider struct {
+	config *config.Config
+	appDir string
+
+	repository *gogit.Repository
+	auth       transport.AuthMethod
+	metadata   map[string]string
+}
+
+func NewNative(config *config.Config, appDir string) *NativeProvider {
+	return &NativeProvider{
+		config: config,
+		appDir: appDir,
+	}
+}
+
+func (p *NativeProvider) Init() error {
+	cfg := p.config.Source.Git
+	switch {
+	case cfg.Submodules:
+		return fmt.Errorf("submodules are not supported by the native backend")
+	case cfg.LFS:
+		return fmt.Errorf("lfs is not supported by the native backend")
+	case cfg.Auth.CredentialHelper != "":
+		return fmt.Errorf("credential helpers are not supported by the native backend")
+	case cfg.Cache != "":
+		return fmt.Errorf("the cache is not supported by the native backend")
+	}
+
+	auth, err := p.authMethod()
+	if err != nil {
+		return fmt.Errorf("failed to configure authentication: %w", err)
+	}
+	p.auth = auth
+
+	p.metadata = make(map[string]string)
+
+	err = p.sync()
+	var corrupted *corruptedError
+	if errors.As(err, &corrupted) {
+		// the source checkout is disposable, start over from a fresh clone
+		p.metadata["recloned"] = corrupted.Error()
+		if err := os.RemoveAll(p.sourcePath()); err != nil {
+			return fmt.Errorf("failed to remove corrupted source checkout: %w", err)
+		}
+
+		err = p.sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.Tags != "" {
+		return p.checkoutTag()
+	}
+
+	return nil
+}
+
+// RemoteRevision asks the remote for the tip of the branch, or for the commit
+// of the tag matching the configured tags.
+func (p *NativeProvider) RemoteRevision() (string, error) {
+	auth, err := p.authMethod()
+	if err != nil {
+		return "", fmt.Errorf("failed to configure authentication: %w", err)
+	}
+
+	var refs []*plumbing.Reference
+	_, err = withRemotes(p.config.Source.Git, func(url string) error {
+		remote := gogit.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+			Name: "origin",
+			URLs: []string{transportURL(url)},
+		})
+		// annotated tags are peeled to their commits
+		refs, err = remote.List(&gogit.ListOptions{Auth: auth, PeelingOption: gogit.AppendPeeled})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote refs: %w", err)
+	}
+
+	if p.config.Source.Git.Tags != "" {
+		hashes := make(map[string]string, len(refs))
+		for _, ref := range refs {
+			hashes[ref.Name().String()] = ref.Hash().String()
+		}
+
+		_, revision, err := selectRemoteTag(hashes, p.config.Source.Git.Tags, p.config.Source.Git.Prerelease)
+		if err != nil {
+			return "", err
+		}
+		return p.peelTag(revision), nil
+	}
+
+	branch := plumbing.NewBranchReferenceName(p.config.Source.Git.Branch)
+	for _, ref := range refs {
+		if ref.Name() == branch {
+			return ref.Hash().String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("branch %s not found on the remote", p.config.Source.Git.Branch)
+}
+
+// peelTag returns the commit of an annotated tag fetched by a previous run.
+// Local repositories are served in-process, which doesn't peel annotated
+// tags when listing them. Any other revision is returned as is.
+func (p *NativeProvider) peelTag(revision string) string {
+	repository, err := gogit.PlainOpen(p.sourcePath())
+	if err != nil {
+		return revision
+	}
+	tag, err := repository.TagObject(plumbing.NewHash(revision))
+	if err != nil {
+		return revision
+	}
+	commit, err := tag.Commit()
+	if err != nil {
+		return revision
+	}
+
+	return commit.Hash.String()
+}
+
+// Metadata reports what happened to the source checkout during Init, such as
+// a re-clone or a rewritten history.
+func (p *NativeProvider) Metadata() map[string]string {
+	return p.metadata
+}
+
+// sync brings the source checkout to the tip of the remote branch, see
+// GitProvider.sync.
+func (p *NativeProvider) sync() error {
+	branch := p.config.Source.Git.Branch
+	remoteBranch := plumbing.NewRemoteReferenceName("origin", branch)
+
+	var previousRevision plumbing.Hash
+
+	if _, err := os.Stat(p.sourcePath()); os.IsNotExist(err) {
+		// cloning is an init followed by the fetch below, which doesn't
+		// depend on the default branch of the remote
+		repository, err := gogit.PlainInit(p.sourcePath(), false)
+		if err != nil {
+			return fmt.Errorf("failed to clone repository: %w", err)
+		}
+		p.repository = repository
+	} else {
+		repository, err := gogit.PlainOpen(p.sourcePath())
+		if err != nil {
+			return &corruptedError{err}
+		}
+		p.repository = repository
+
+		if ref, err := repository.Reference(remoteBranch, true); err == nil {
+			previousRevision = ref.Hash()
+		}
+	}
+
+	if err := p.setRemoteURL(); err != nil {
+		return &corruptedError{err}
+	}
+
+	refSpec := gitconfig.RefSpec(fmt.Sprintf("+refs/heads/%s:%s", branch, remoteBranch))
+	if err := p.fetch(refSpec); err != nil {
+		return fmt.Errorf("failed to fetch latest changes: %w", err)
+	}
+
+	ref, err := p.repository.Reference(remoteBranch, true)
+	if err != nil {
+		return &corruptedError{err}
+	}
+	revision := ref.Hash()
+
+	if !previousRevision.IsZero() && previousRevision != revision {
+		if rewritten, err := p.rewritten(previousRevision, revision); err == nil && rewritten {
+			p.metadata["history_rewritten"] = fmt.Sprintf("%s is no longer an ancestor of %s", previousRevision, revision)
+		}
+	}
+
+	// equivalent to a hard reset to the remote branch
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	if err := p.repository.Storer.SetReference(plumbing.NewHashReference(branchRef, revision)); err != nil {
+		return &corruptedError{err}
+	}
+	if err := p.checkout(&gogit.CheckoutOptions{Branch: branchRef, Force: true}); err != nil {
+		return &corruptedError{err}
+	}
+
+	return nil
+}
+
+// rewritten reports whether the previous revision is no longer part of the
+// history of the revision. An unknown previous revision isn't a rewrite.
+func (p *NativeProvider) rewritten(previousRevision, revision plumbing.Hash) (bool, error) {
+	previous, err := p.repository.CommitObject(previousRevision)
+	if err != nil {
+		return false, err
+	}
+	current, err := p.repository.CommitObject(revision)
+	if err != nil {
+		return false, err
+	}
+
+	ancestor, err := previous.IsAncestor(current)
+	if err != nil {
+		return false, err
+	}
+
+	return !ancestor, nil
+}
+
+// checkoutTag checks out the highest tag matching the configured tags.
+func (p *NativeProvider) checkoutTag() error {
+	if err := p.fetch("+refs/tags/*:refs/tags/*"); err != nil {
+		return fmt.Errorf("failed to fetch tags: %w", err)
+	}
+
+	iter, err := p.repository.Tags()
+	if err != nil {
+		return fmt.Errorf("failed to list tags: %w", err)
+	}
+	var tags []string
+	_ = iter.ForEach(func(ref *plumbing.Reference) error {
+		tags = append(tags, ref.Name().Short())
+		return nil
+	})
+
+	tag, err := selectTag(tags, p.config.Source.Git.Tags, p.config.Source.Git.Prerelease)
+	if err != nil {
+		return err
+	}
+
+	revision, err := p.resolveCommit(plumbing.NewTagReferenceName(tag).String())
+	if err != nil {
+		return fmt.Errorf("failed to resolve tag %s: %w", tag, err)
+	}
+	if err := p.checkout(&gogit.CheckoutOptions{Hash: revision, Force: true}); err != nil {
+		return fmt.Errorf("failed to checkout tag %s: %w", tag, err)
+	}
+	p.metadata["tag"] = tag
+
+	return nil
+}
+
+// ResolveRef resolves a branch, a tag or a commit hash to a commit and checks
+// it out in the source checkout.
+func (p *NativeProvider) ResolveRef(ref string) (string, error) {
+	// tags and the branch of the same name may have moved since the last run.
+	// A ref that doesn't name a branch fails the second fetch, so the errors
+	// only count if the ref can't be resolved at all
+	var fetchErrs []error
+	if err := p.fetch("+refs/tags/*:refs/tags/*"); err != nil {
+		fetchErrs = append(fetchErrs, fmt.Errorf("failed to fetch tags: %w", err))
+		p.metadata["ref_fetch_error"] = err.Error()
+	}
+	if err := p.fetch(gitconfig.RefSpec(fmt.Sprintf("+refs/heads/%s:%s", ref, plumbing.NewRemoteReferenceName("origin", ref)))); err != nil {
+		fetchErrs = append(fetchErrs, fmt.Errorf("failed to fetch branch: %w", err))
+	}
+
+	candidates := []string{
+		plumbing.NewRemoteReferenceName("origin", ref).String(),
+		plumbing.NewTagReferenceName(ref).String(),
+		ref,
+	}
+
+	var revision plumbing.Hash
+	var err error
+	for _, candidate := range candidates {
+		if revision, err = p.resolveCommit(candidate); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if len(fetchErrs) > 0 {
+			return "", fmt.Errorf("failed to resolve ref %s: %w: %w", ref, err, errors.Join(fetchErrs...))
+		}
+		return "", fmt.Errorf("failed to resolve ref %s: %w", ref, err)
+	}
+
+	if err := p.checkout(&gogit.CheckoutOptions{Hash: revision, Force: true}); err != nil {
+		return "", fmt.Errorf("failed to checkout ref %s: %w", ref, err)
+	}
+
+	return revision.String(), nil
+}
+
+func (p *NativeProvider) GetRevision() (string, error) {
+	head, err := p.repository.Head()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+
+	return head.Hash().String(), nil
+}
+
+// Clone writes the tree of HEAD, or of the configured path in it, into the
+// target directory.
+func (p *NativeProvider) Clone(targetDir string) error {
+	tree, err := p.headTree()
+	if err != nil {
+		return err
+	}
+
+	if path := strings.Trim(p.config.Source.Git.Path, "/"); path != "" {
+		tree, err = tree.Tree(path)
+		if err != nil {
+			return fmt.Errorf("failed to read path %s: %w", path, err)
+		}
+	}
+
+	err = tree.Files().ForEach(func(file *object.File) error {
+		return exportFile(file, filepath.Join(targetDir, filepath.FromSlash(file.Name)))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy repository files: %w", err)
+	}
+
+	return nil
+}
+
+// Changed reports whether any of the watched paths differ between the two
+// revisions, see GitProvider.Changed.
+func (p *NativeProvider) Changed(fromRevision, toRevision string) (bool, error) {
+	paths := p.config.Source.Git.WatchPaths
+	if len(paths) == 0 && p.config.Source.Git.Path != "" {
+		paths = []string{p.config.Source.Git.Path}
+	}
+	if len(paths) == 0 {
+		return fromRevision != toRevision, nil
+	}
+
+	from, err := p.repository.CommitObject(plumbing.NewHash(fromRevision))
+	if err != nil {
+		// the previous revision is gone, e.g. after a history rewrite
+		return true, nil
+	}
+	to, err := p.repository.CommitObject(plumbing.NewHash(toRevision))
+	if err != nil {
+		return false, fmt.Errorf("failed to read revision %s: %w", toRevision, err)
+	}
+
+	for _, path := range paths {
+		path = strings.Trim(path, "/")
+		if treeHash(from, path) != treeHash(to, path) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// treeHash returns the hash of the object at the path in the commit, or the
+// zero hash if the path doesn't exist there.
+func treeHash(commit *object.Commit, path string) plumbing.Hash {
+	tree, err := commit.Tree()
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	if path == "" {
+		return tree.Hash
+	}
+
+	entry, err := tree.FindEntry(path)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+
+	return entry.Hash
+}
+
+func (p *NativeProvider) headTree() (*object.Tree, error) {
+	head, err := p.repository.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+
+	commit, err := p.repository.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HEAD commit: %w", err)
+	}
+
+	return commit.Tree()
+}
+
+func (p *NativeProvider) resolveCommit(revision string) (plumbing.Hash, error) {
+	hash, err := p.repository.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// peel annotated tags
+	commit, err := p.repository.CommitObject(*hash)
+	if err != nil {
+		tag, tagErr := p.repository.TagObject(*hash)
+		if tagErr != nil {
+			return plumbing.ZeroHash, err
+		}
+		if commit, err = tag.Commit(); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	return commit.Hash, nil
+}
+
+// fetch fetches the refspecs from the repository or its mirrors, see
+// withRemotes.
+func (p *NativeProvider) fetch(refSpecs ...gitconfig.RefSpec) error {
+	url, err := withRemotes(p.config.Source.Git, func(url string) error {
+		err := p.repository.Fetch(&gogit.FetchOptions{
+			RemoteName: "origin",
+			RemoteURL:  transportURL(url),
+			RefSpecs:   refSpecs,
+			Auth:       p.auth,
+			Tags:       gogit.NoTags,
+			Force:      true,
+		})
+		if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if url != p.config.Source.Git.Repo {
+		p.metadata["mirror"] = url
+	}
+
+	return nil
+}
+
+// checkout checks out the commit and removes untracked files. Only the
+// configured path is checked out if there is one.
+func (p *NativeProvider) checkout(opts *gogit.CheckoutOptions) error {
+	worktree, err := p.repository.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if path := strings.Trim(p.config.Source.Git.Path, "/"); path != "" {
+		opts.SparseCheckoutDirectories = []string{path}
+	}
+
+	if err := worktree.Checkout(opts); err != nil {
+		return err
+	}
+
+	return worktree.Clean(&gogit.CleanOptions{Dir: true})
+}
+
+func (p *NativeProvider) setRemoteURL() error {
+	cfg, err := p.repository.Config()
+	if err != nil {
+		return err
+	}
+
+	remote, ok := cfg.Remotes["origin"]
+	if !ok {
+		remote = &gitconfig.RemoteConfig{Name: "origin"}
+		cfg.Remotes["origin"] = remote
+	}
+	remote.URLs = []string{p.config.Source.Git.Repo}
+	remote.Fetch = []gitconfig.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+
+	return p.repository.SetConfig(cfg)
+}
+
+// authMethod returns the credentials for the transport of the repository,
+// nil uses the defaults, e.g. the ssh agent.
+func (p *NativeProvider) authMethod() (transport.AuthMethod, error) {
+	creds, err := loadCredentials(p.appDir, p.config.Source.Git.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := transport.NewEndpoint(p.config.Source.Git.Repo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository url: %w", err)
+	}
+
+	switch endpoint.Protocol {
+	case "http", "https":
+		if creds.token == "" {
+			return nil, nil
+		}
+		return &http.BasicAuth{Username: creds.username, Password: creds.token}, nil
+	case "ssh":
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+
+		var auth *ssh.PublicKeys
+		if creds.sshKey != "" {
+			if auth, err = ssh.NewPublicKeysFromFile(user, creds.sshKey, ""); err != nil {
+				return nil, fmt.Errorf("failed to load ssh key: %w", err)
+			}
+		} else if creds.knownHosts != "" {
+			return nil, fmt.Errorf("known hosts require an ssh key with the native backend")
+		} else {
+			return nil, nil
+		}
+
+		if creds.knownHosts != "" {
+			callback, err := ssh.NewKnownHostsCallback(creds.knownHosts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load known hosts: %w", err)
+			}
+			auth.HostKeyCallback = callback
+		}
+
+		return auth, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (p *NativeProvider) sourcePath() string {
+	return filepath.Join(p.appDir, ".git")
+}
+
+// exportFile writes a file of a tree, keeping the executable bit and
+// symlinks.
+func exportFile(file *object.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(path)
+		return os.Symlink(target, path)
+	}
+
+	perm := os.FileMode(0644)
+	if file.Mode == filemode.Executable {
+		perm = 0755
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,149 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/utils"
+)
+
+const (
+	// attempts per remote, before moving on to the next mirror
+	remoteAttempts = 4
+
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// permanentPatterns match the messages of errors that won't go away by
+// trying again, they take precedence over the transient ones.
+var permanentPatterns = []string{
+	"authentication failed",
+	"authentication required",
+	"authorization failed",
+	"could not read username",
+	"could not read password",
+	"permission denied",
+	"host key verification failed",
+	"repository not found",
+	"does not appear to be a git repository",
+	"couldn't find remote ref",
+	"no matching ref",
+	"returned error: 401",
+	"returned error: 403",
+	"returned error: 404",
+}
+
+var transientPatterns = []string{
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"name or service not known",
+	"timed out",
+	"timeout",
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"network is unreachable",
+	"no route to host",
+	"early eof",
+	"unexpected disconnect",
+	"the remote end hung up unexpectedly",
+	"rpc failed",
+	"gnutls_handshake",
+	"tls handshake",
+	"ssl_read",
+	"http/2 stream",
+}
+
+// 5xx responses, as reported by git and by go-git
+var serverErrorPattern = regexp.MustCompile(`returned error: 5\d\d|status code: 5\d\d`)
+
+// isTransient reports whether the error of a remote operation is likely to
+// go away by trying again, such as a DNS failure, a timeout or an HTTP 5xx.
+// Unknown errors are permanent, so they fail fast.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, transport.ErrAuthenticationRequired) ||
+		errors.Is(err, transport.ErrAuthorizationFailed) ||
+		errors.Is(err, transport.ErrRepositoryNotFound) {
+		return false
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, pattern := range permanentPatterns {
+		if strings.Contains(message, pattern) {
+			return false
+		}
+	}
+	if serverErrorPattern.MatchString(message) {
+		return true
+	}
+	for _, pattern := range transientPatterns {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withRemotes runs the operation against the repository, then against each
+// mirror in order, until it succeeds. Transient errors are retried with an
+// exponential backoff and jitter before moving on to the next remote,
+// permanent errors are returned right away. It returns the remote that
+// succeeded.
+func withRemotes(cfg config.GitConfig, op func(url string) error) (string, error) {
+	backoff, err := utils.ParseDuration(cfg.RetryBackoff, defaultRetryBackoff)
+	if err != nil {
+		return "", fmt.Errorf("invalid retry backoff: %w", err)
+	}
+
+	remotes := append([]string{cfg.Repo}, cfg.Mirrors...)
+
+	for _, url := range remotes {
+		delay := backoff
+		for attempt := 1; ; attempt++ {
+			err = op(url)
+			if err == nil {
+				return url, nil
+			}
+			if !isTransient(err) {
+				return "", err
+			}
+			if attempt == remoteAttempts {
+				break
+			}
+
+			// full jitter, so a fleet doesn't retry in lockstep
+			if delay > 0 {
+				time.Sleep(time.Duration(rand.Int64N(int64(delay))))
+			}
+			delay = min(delay*2, maxRetryBackoff)
+		}
+	}
+
+	return "", err
+}
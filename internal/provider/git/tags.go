@@ -0,0 +1,136 @@
+package git
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// selectTag returns the tag with the highest semantic version matching the
+// pattern, which is either a semver constraint like ">=2.0.0 <3.0.0" or a
+// glob like "glob:v*". Tags that aren't semantic versions are ignored.
+func selectTag(tags []string, pattern string, prerelease bool) (string, error) {
+	match, err := tagMatcher(pattern, prerelease)
+	if err != nil {
+		return "", err
+	}
+
+	var selected string
+	var highest *semver.Version
+	for _, tag := range tags {
+		version, err := semver.NewVersion(tag)
+		if err != nil {
+			continue
+		}
+		if version.Prerelease() != "" && !prerelease {
+			continue
+		}
+		if !match(tag, version) {
+			continue
+		}
+
+		if highest == nil || version.GreaterThan(highest) {
+			selected = tag
+			highest = version
+		}
+	}
+
+	if selected == "" {
+		return "", fmt.Errorf("no tag matches %s", pattern)
+	}
+
+	return selected, nil
+}
+
+// selectRemoteTag selects the tag from the refs advertised by the remote, by
+// their names, and returns it along with its commit. The name of an annotated
+// tag peeled to its commit is suffixed with ^{}, e.g. refs/tags/v1.0.0^{}.
+func selectRemoteTag(refs map[string]string, pattern string, prerelease bool) (string, string, error) {
+	commits := make(map[string]string)
+	for name, hash := range refs {
+		name, ok := strings.CutPrefix(name, "refs/tags/")
+		if !ok {
+			continue
+		}
+		if tag, peeled := strings.CutSuffix(name, "^{}"); peeled {
+			commits[tag] = hash
+		} else if _, ok := commits[name]; !ok {
+			commits[name] = hash
+		}
+	}
+
+	tags := make([]string, 0, len(commits))
+	for tag := range commits {
+		tags = append(tags, tag)
+	}
+
+	tag, err := selectTag(tags, pattern, prerelease)
+	if err != nil {
+		return "", "", err
+	}
+
+	return tag, commits[tag], nil
+}
+
+// tagMatcher returns the check of the pattern. A pattern is a glob only if it
+// isn't a semver constraint, e.g. "v1.[0-9]*", or if it's prefixed with
+// "glob:", as "v*" and "2.*" are constraints too.
+func tagMatcher(pattern string, prerelease bool) (func(tag string, version *semver.Version) bool, error) {
+	if glob, ok := strings.CutPrefix(pattern, "glob:"); ok {
+		return globMatcher(glob)
+	}
+
+	constraint, err := semver.NewConstraint(pattern)
+	if err != nil {
+		if strings.ContainsAny(pattern, "*?[") {
+			return globMatcher(pattern)
+		}
+		return nil, fmt.Errorf("invalid tag constraint %s: %w", pattern, err)
+	}
+
+	return func(_ string, version *semver.Version) bool {
+		if constraint.Check(version) {
+			return true
+		}
+		if !prerelease || version.Prerelease() == "" {
+			return false
+		}
+
+		// constraints never match pre-releases unless they name one. A
+		// pre-release is ordered after the release before it and before the
+		// release it leads up to, it matches if both of them do, so 2.0.0-rc.1
+		// doesn't match >=2.0.0
+		release := semver.New(version.Major(), version.Minor(), version.Patch(), "", "")
+		before, ok := releaseBefore(release)
+		return ok && constraint.Check(release) && constraint.Check(before)
+	}, nil
+}
+
+func globMatcher(pattern string) (func(tag string, version *semver.Version) bool, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid tag pattern %s: %w", pattern, err)
+	}
+
+	return func(tag string, _ *semver.Version) bool {
+		matched, _ := path.Match(pattern, tag)
+		return matched
+	}, nil
+}
+
+// releaseBefore returns the highest release lower than the release, no
+// constraint can tell them apart from the pre-releases in between.
+func releaseBefore(release *semver.Version) (*semver.Version, bool) {
+	switch {
+	case release.Patch() > 0:
+		return semver.New(release.Major(), release.Minor(), release.Patch()-1, "", ""), true
+	case release.Minor() > 0:
+		return semver.New(release.Major(), release.Minor()-1, math.MaxUint64, "", ""), true
+	case release.Major() > 0:
+		return semver.New(release.Major()-1, math.MaxUint64, math.MaxUint64, "", ""), true
+	default:
+		return nil, false
+	}
+}
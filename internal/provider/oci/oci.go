@@ -0,0 +1,388 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/provider/archive"
+	"github.com/serversfordev/deploy/internal/signature"
+	"github.com/serversfordev/deploy/internal/utils"
+)
+
+const (
+	defaultTimeout = 10 * time.Minute
+	blobsDir       = ".artifacts/blobs"
+
+	// annotations set by oras for pushed files and directories
+	annotationTitle  = "org.opencontainers.image.title"
+	annotationUnpack = "io.deis.oras.content.unpack"
+
+	signatureSuffix = ".minisig"
+)
+
+// OCIProvider deploys artifacts pushed to an OCI registry. The tag is
+// resolved to the digest of its manifest, which is the revision, and the
+// layers of the manifest are extracted into the release.
+type OCIProvider struct {
+	config *config.Config
+	appDir string
+
+	image    *reference
+	registry *registry
+	manifest *manifest
+	digest   string
+	ref      string
+	signedBy string
+}
+
+func New(config *config.Config, appDir string) *OCIProvider {
+	return &OCIProvider{
+		config: config,
+		appDir: appDir,
+	}
+}
+
+// Init resolves the tag to its manifest.
+func (p *OCIProvider) Init() error {
+	if err := p.initRegistry(); err != nil {
+		return err
+	}
+
+	return p.resolve(p.image.Reference)
+}
+
+// RemoteRevision returns the digest the tag points to, without fetching the
+// manifest.
+func (p *OCIProvider) RemoteRevision() (string, error) {
+	if err := p.initRegistry(); err != nil {
+		return "", err
+	}
+
+	digest, err := p.registry.resolve(p.image.Reference)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", p.image, err)
+	}
+
+	return digest, nil
+}
+
+func (p *OCIProvider) GetRevision() (string, error) {
+	if p.manifest == nil {
+		return "", fmt.Errorf("manifest hasn't been resolved yet")
+	}
+	return p.digest, nil
+}
+
+// ResolveRef pins the source to another tag or digest of the repository.
+func (p *OCIProvider) ResolveRef(ref string) (string, error) {
+	if err := p.resolve(ref); err != nil {
+		return "", fmt.Errorf("failed to resolve ref %s: %w", ref, err)
+	}
+
+	return p.digest, nil
+}
+
+// Clone pulls the layers and extracts them into the release, in the order of
+// the manifest.
+func (p *OCIProvider) Clone(targetDir string) error {
+	layers, err := p.layers()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(p.appDir, blobsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create blobs directory: %w", err)
+	}
+
+	keep := map[string]bool{}
+	pull := func(layer descriptor) (string, error) {
+		blob := filepath.Join(dir, strings.ReplaceAll(layer.Digest, ":", "-"))
+		keep[filepath.Base(blob)] = true
+
+		if info, err := os.Stat(blob); err != nil || info.Size() != layer.Size {
+			if err := p.registry.download(layer, blob); err != nil {
+				return "", fmt.Errorf("failed to pull layer %s: %w", layer.Digest, err)
+			}
+		}
+		return blob, nil
+	}
+
+	blobs := make([]string, len(layers))
+	for i, layer := range layers {
+		if blobs[i], err = pull(layer); err != nil {
+			return err
+		}
+	}
+
+	// every layer is verified before anything is extracted
+	p.signedBy = ""
+	if len(p.config.Source.Signature.PublicKeys) > 0 {
+		for i, layer := range layers {
+			sigBlob, err := pull(*p.signatureLayer(layer))
+			if err != nil {
+				return err
+			}
+			key, err := verifyLayer(layer, blobs[i], sigBlob, p.config.Source.Signature.PublicKeys)
+			if err != nil {
+				return err
+			}
+			p.signedBy = key
+		}
+	}
+
+	for i, layer := range layers {
+		if err := p.extract(layer, blobs[i], targetDir); err != nil {
+			return fmt.Errorf("failed to extract layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	// only the blobs of the current manifest are kept
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if !keep[entry.Name()] {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return nil
+}
+
+// Metadata reports the deployed image.
+func (p *OCIProvider) Metadata() map[string]string {
+	if p.manifest == nil {
+		return nil
+	}
+
+	image := *p.image
+	image.Reference = p.ref
+	layers, _ := p.layers()
+
+	metadata := map[string]string{
+		"image":  image.String(),
+		"digest": p.digest,
+		"layers": strconv.Itoa(len(layers)),
+	}
+	if p.signedBy != "" {
+		metadata["signed_by"] = p.signedBy
+	}
+
+	return metadata
+}
+
+func (p *OCIProvider) initRegistry() error {
+	cfg := p.config.Source.OCI
+	if cfg.Image == "" {
+		return fmt.Errorf("oci image is not configured")
+	}
+
+	image, err := parseReference(cfg.Image)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := utils.ParseDuration(cfg.Timeout, defaultTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+
+	password := ""
+	if cfg.TokenEnv != "" {
+		password = os.Getenv(cfg.TokenEnv)
+		if password == "" {
+			return fmt.Errorf("environment variable %s is empty", cfg.TokenEnv)
+		}
+	}
+
+	// local registries are usually served over plain http
+	scheme := "https"
+	if cfg.Insecure {
+		scheme = "http"
+	}
+
+	p.image = image
+	p.registry = &registry{
+		base:       &url.URL{Scheme: scheme, Host: image.Host()},
+		repository: image.Repository,
+		username:   cfg.Username,
+		password:   password,
+		client:     &http.Client{Timeout: timeout},
+	}
+
+	return nil
+}
+
+func (p *OCIProvider) resolve(ref string) error {
+	m, digest, err := p.registry.manifest(ref)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", p.image, err)
+	}
+
+	p.manifest = m
+	p.digest = digest
+	p.ref = ref
+
+	layers, err := p.layers()
+	if err != nil {
+		return err
+	}
+
+	// fail before a release is created if the layers can't be verified
+	if len(p.config.Source.Signature.PublicKeys) > 0 {
+		for _, layer := range layers {
+			if layer.Annotations[annotationTitle] == "" {
+				return fmt.Errorf("layer %s of %s has no title, its signature can't be found", layer.Digest, p.image)
+			}
+			if p.signatureLayer(layer) == nil {
+				return fmt.Errorf("layer %s of %s has no signature, push %s%s along with it",
+					layer.Digest, p.image, layerName(layer), signatureSuffix)
+			}
+		}
+	}
+
+	return nil
+}
+
+// layers returns the layers of the manifest with an allowed media type.
+// Signature layers are never extracted.
+func (p *OCIProvider) layers() ([]descriptor, error) {
+	allowed := p.config.Source.OCI.MediaTypes
+
+	var layers []descriptor
+	for _, layer := range p.manifest.Layers {
+		if strings.HasSuffix(layer.Annotations[annotationTitle], signatureSuffix) {
+			continue
+		}
+		if len(allowed) == 0 || slices.Contains(allowed, layer.MediaType) {
+			layers = append(layers, layer)
+		}
+	}
+
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("manifest %s has no layers with an allowed media type", p.digest)
+	}
+
+	return layers, nil
+}
+
+// signatureLayer returns the layer holding the signature of the layer, a
+// file pushed under the title of the layer with .minisig appended, or nil.
+func (p *OCIProvider) signatureLayer(layer descriptor) *descriptor {
+	title := layer.Annotations[annotationTitle]
+	if title == "" {
+		return nil
+	}
+
+	for i, candidate := range p.manifest.Layers {
+		if candidate.Annotations[annotationTitle] == title+signatureSuffix {
+			return &p.manifest.Layers[i]
+		}
+	}
+	return nil
+}
+
+// verifyLayer checks the signature of the layer against the trusted keys and
+// returns the key that made it.
+func verifyLayer(layer descriptor, blob, sigBlob string, publicKeys []string) (string, error) {
+	sig, err := os.ReadFile(sigBlob)
+	if err != nil {
+		return "", fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	verified, err := signature.VerifyWithKeys(blob, sig, publicKeys)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify layer %s: %w", layerName(layer), err)
+	}
+
+	return verified.Key.String(), nil
+}
+
+// layerName returns the title of the layer, or its digest for an untitled
+// layer.
+func layerName(layer descriptor) string {
+	if title := layer.Annotations[annotationTitle]; title != "" {
+		return title
+	}
+	return layer.Digest
+}
+
+// extract extracts an archive layer into the release. A file pushed by oras
+// that isn't an archive is copied into the release under its title.
+func (p *OCIProvider) extract(layer descriptor, blob, targetDir string) error {
+	strip := p.config.Source.OCI.StripComponents
+
+	title := layer.Annotations[annotationTitle]
+	if title == "" {
+		format := layerFormat(layer.MediaType)
+		if format == "" {
+			return fmt.Errorf("unknown layer media type %s, allow only archive layers with media_types", layer.MediaType)
+		}
+		return archive.Extract(blob, format, targetDir, strip)
+	}
+
+	if layer.Annotations[annotationUnpack] == "true" {
+		return archive.Extract(blob, archive.FormatTarGz, targetDir, strip)
+	}
+	if format := archive.DetectFormat(title); format != "" {
+		return archive.Extract(blob, format, targetDir, strip)
+	}
+
+	return copyFile(blob, targetDir, title)
+}
+
+// layerFormat returns the archive format of a layer by its media type, e.g.
+// application/vnd.oci.image.layer.v1.tar+gzip.
+func layerFormat(mediaType string) string {
+	mediaType = strings.ToLower(mediaType)
+	switch {
+	case strings.HasSuffix(mediaType, "tar+gzip"), strings.HasSuffix(mediaType, ".tar.gzip"):
+		return archive.FormatTarGz
+	case strings.HasSuffix(mediaType, "tar+zstd"), strings.HasSuffix(mediaType, ".tar.zstd"):
+		return archive.FormatTarZst
+	case strings.HasSuffix(mediaType, ".tar"):
+		return archive.FormatTar
+	case strings.HasSuffix(mediaType, "zip"):
+		return archive.FormatZip
+	default:
+		return ""
+	}
+}
+
+// copyFile copies a blob into the release. The name has to be a plain file
+// name, so it can't point outside of the release.
+func copyFile(blob, targetDir, name string) error {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+
+	target := filepath.Join(targetDir, name)
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	in, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
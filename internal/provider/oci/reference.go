@@ -0,0 +1,81 @@
+package oci
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	dockerHub         = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+	defaultTag        = "latest"
+)
+
+// reference is a parsed image reference, e.g.
+// registry.example.com/team/app:stable or registry.example.com/team/app@sha256:...
+type reference struct {
+	Registry   string
+	Repository string
+	// Reference is the tag or the digest
+	Reference string
+}
+
+// parseReference parses an image reference. Without a registry the reference
+// points to Docker Hub, without a tag or digest to the latest tag.
+func parseReference(value string) (*reference, error) {
+	name, ref := value, ""
+	if i := strings.Index(value, "@"); i >= 0 {
+		name, ref = value[:i], value[i+1:]
+		if !isDigest(ref) {
+			return nil, fmt.Errorf("invalid image reference %s: invalid digest", value)
+		}
+	} else if i := strings.LastIndex(value, ":"); i > strings.LastIndex(value, "/") {
+		name, ref = value[:i], value[i+1:]
+	}
+	if ref == "" {
+		ref = defaultTag
+	}
+
+	registry, repository := dockerHub, name
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			registry, repository = first, name[i+1:]
+		}
+	}
+	if registry == dockerHub && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	if repository == "" || strings.ToLower(repository) != repository {
+		return nil, fmt.Errorf("invalid image reference %s: invalid repository", value)
+	}
+
+	return &reference{
+		Registry:   registry,
+		Repository: repository,
+		Reference:  ref,
+	}, nil
+}
+
+// Host returns the host the registry API is served from.
+func (r *reference) Host() string {
+	if r.Registry == dockerHub {
+		return dockerHubRegistry
+	}
+	return r.Registry
+}
+
+func (r *reference) String() string {
+	separator := ":"
+	if isDigest(r.Reference) {
+		separator = "@"
+	}
+	return r.Registry + "/" + r.Repository + separator + r.Reference
+}
+
+// isDigest reports whether the reference is a digest rather than a tag.
+func isDigest(ref string) bool {
+	algorithm, hex, ok := strings.Cut(ref, ":")
+	return ok && algorithm != "" && hex != ""
+}
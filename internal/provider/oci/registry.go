@@ -0,0 +1,350 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// manifest media types, see https://github.com/opencontainers/image-spec
+const (
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	maxManifestSize = 4 << 20
+)
+
+var manifestMediaTypes = []string{
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+	mediaTypeDockerManifest,
+	mediaTypeDockerList,
+}
+
+// descriptor points to a manifest or a blob.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *platform         `json:"platform,omitempty"`
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// manifest is an image manifest or an index of manifests.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests,omitempty"`
+	Layers    []descriptor `json:"layers,omitempty"`
+}
+
+// registry talks to the distribution API of a registry, see
+// https://github.com/opencontainers/distribution-spec
+type registry struct {
+	base       *url.URL
+	repository string
+	username   string
+	password   string
+	client     *http.Client
+
+	// the authorization of the previous request, reused until it's rejected
+	authorization string
+}
+
+// resolve returns the digest of the manifest the reference points to.
+func (r *registry) resolve(ref string) (string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	resp, err := r.do(http.MethodHead, "manifests/"+ref, header)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// the header is optional, the digest of the content is the same
+	_, digest, err := r.manifest(ref)
+	return digest, err
+}
+
+// manifest returns the manifest the reference points to and its digest. An
+// index is resolved to the manifest for the platform of the host.
+func (r *registry) manifest(ref string) (*manifest, string, error) {
+	m, digest, err := r.fetchManifest(ref)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if m.MediaType != mediaTypeOCIIndex && m.MediaType != mediaTypeDockerList {
+		return m, digest, nil
+	}
+
+	entry, err := selectPlatform(m.Manifests)
+	if err != nil {
+		return nil, "", err
+	}
+	m, _, err = r.fetchManifest(entry.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return m, digest, nil
+}
+
+func (r *registry) fetchManifest(ref string) (*manifest, string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	resp, err := r.do(http.MethodGet, "manifests/"+ref, header)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest %s is too large", ref)
+	}
+
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if isDigest(ref) && ref != digest {
+		return nil, "", fmt.Errorf("digest mismatch for manifest %s: got %s", ref, digest)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, "", fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	return &m, digest, nil
+}
+
+// download stores the blob in the file, verifying its digest.
+func (r *registry) download(blob descriptor, file string) error {
+	algorithm, expected, _ := strings.Cut(blob.Digest, ":")
+	if algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm: %s", algorithm)
+	}
+
+	resp, err := r.do(http.MethodGet, "blobs/"+blob.Digest, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	partial := file + ".partial"
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		out.Close()
+		os.Remove(partial)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		os.Remove(partial)
+		return fmt.Errorf("digest mismatch for blob %s: got sha256:%s", blob.Digest, actual)
+	}
+
+	return os.Rename(partial, file)
+}
+
+// do sends a request to the repository. A rejected request is retried once
+// with the authorization the registry asks for.
+func (r *registry) do(method, path string, header http.Header) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		u := r.base.JoinPath("v2", r.repository, path)
+		req, err := http.NewRequest(method, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if r.authorization != "" {
+			req.Header.Set("Authorization", r.authorization)
+		}
+		return r.client.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		if err := r.authorize(resp.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+		if resp, err = send(); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	// the error response names the reason, e.g. MANIFEST_UNKNOWN
+	var registryErr struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &registryErr) == nil && len(registryErr.Errors) > 0 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, registryErr.Errors[0].Code, registryErr.Errors[0].Message)
+	}
+
+	return nil, fmt.Errorf("%s %s: unexpected status code %d", method, path, resp.StatusCode)
+}
+
+// authorize answers the challenge of the registry, with basic auth or with a
+// bearer token of the token service, see
+// https://distribution.github.io/distribution/spec/auth/token/
+func (r *registry) authorize(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.username == "" && r.password == "" {
+			return fmt.Errorf("registry requires authentication, configure the credentials")
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(r.username, r.password)
+		r.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("registry rejected the request: unsupported authentication %q", scheme)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("registry rejected the request: invalid token realm %q", params["realm"])
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.repository + ":pull"
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.username != "" || r.password != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to request token: unexpected status code %d", resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to parse token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("failed to request token: empty token")
+	}
+
+	r.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.example.com/token",service="registry",scope="repository:app:pull"
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+
+	for rest != "" {
+		var key string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		if key != "" {
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+
+	return scheme, params
+}
+
+// selectPlatform picks the manifest for the platform of the host from an
+// index. An index with a single manifest is used regardless of its platform.
+func selectPlatform(manifests []descriptor) (*descriptor, error) {
+	if len(manifests) == 1 {
+		return &manifests[0], nil
+	}
+
+	for i, entry := range manifests {
+		if entry.Platform != nil && entry.Platform.OS == runtime.GOOS && entry.Platform.Architecture == runtime.GOARCH {
+			return &manifests[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("index has no manifest for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
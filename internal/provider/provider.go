@@ -4,19 +4,59 @@ import (
 	"fmt"
 
 	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/provider/archive"
+	"github.com/serversfordev/deploy/internal/provider/bundle"
+	"github.com/serversfordev/deploy/internal/provider/dir"
 	"github.com/serversfordev/deploy/internal/provider/git"
+	"github.com/serversfordev/deploy/internal/provider/oci"
+	"github.com/serversfordev/deploy/internal/provider/s3"
 )
 
 type Provider interface {
 	Init() error
+	// RemoteRevision returns the revision Init would check out, without
+	// fetching anything. An empty revision means it can't be told cheaply.
+	RemoteRevision() (string, error)
 	GetRevision() (string, error)
+	// ResolveRef resolves a ref to a revision and pins the source to it, so
+	// GetRevision and Clone use that revision instead of the latest one.
+	ResolveRef(ref string) (string, error)
 	Clone(targetDir string) error
 }
 
+// MetadataProvider is implemented by providers that report details about
+// the source, which are logged and recorded in the release metadata.
+type MetadataProvider interface {
+	Metadata() map[string]string
+}
+
+// ChangeDetector is implemented by providers that can tell whether the
+// changes between two revisions are relevant for the deployment.
+type ChangeDetector interface {
+	Changed(fromRevision, toRevision string) (bool, error)
+}
+
 func New(cfg *config.Config, appDir string) (Provider, error) {
 	switch cfg.Source.Provider {
 	case "git":
-		return git.New(cfg, appDir), nil
+		switch cfg.Source.Git.Backend {
+		case "", "exec":
+			return git.New(cfg, appDir), nil
+		case "native":
+			return git.NewNative(cfg, appDir), nil
+		default:
+			return nil, fmt.Errorf("unknown git backend: %s", cfg.Source.Git.Backend)
+		}
+	case "bundle":
+		return bundle.New(cfg, appDir), nil
+	case "dir":
+		return dir.New(cfg, appDir), nil
+	case "archive":
+		return archive.New(cfg, appDir), nil
+	case "s3":
+		return s3.New(cfg, appDir), nil
+	case "oci":
+		return oci.New(cfg, appDir), nil
 	default:
 		return nil, fmt.Errorf("unknown provider type: %s", cfg.Source.Provider)
 	}
@@ -0,0 +1,182 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for objects that don't exist.
+var ErrNotFound = errors.New("object not found")
+
+// Client is a minimal S3 client for the requests the provider needs, signed
+// with Signature Version 4. It works with AWS S3 and compatible storages
+// such as MinIO and R2.
+type Client struct {
+	Endpoint *url.URL
+	Region   string
+	Bucket   string
+	// VirtualHosted addresses the bucket as a subdomain of the endpoint,
+	// instead of the first segment of the path
+	VirtualHosted bool
+	Credentials   Credentials
+	HTTPClient    *http.Client
+}
+
+// Object describes an object in the bucket.
+type Object struct {
+	Key       string
+	ETag      string
+	VersionID string
+	Size      int64
+}
+
+// Head returns the details of the object.
+func (c *Client) Head(key string) (*Object, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &Object{
+		Key:       key,
+		ETag:      strings.Trim(resp.Header.Get("ETag"), `"`),
+		VersionID: resp.Header.Get("X-Amz-Version-Id"),
+		Size:      resp.ContentLength,
+	}, nil
+}
+
+// Get returns the contents of the object, starting at the offset. The
+// response status is 206 if the range was honored.
+func (c *Client) Get(key string, offset int64) (*http.Response, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	return c.do(http.MethodGet, key, nil, header, nil)
+}
+
+// Put uploads the object.
+func (c *Client) Put(key string, data []byte) error {
+	resp, err := c.do(http.MethodPut, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List returns all objects with the prefix.
+func (c *Client) List(prefix string) ([]Object, error) {
+	var objects []Object
+
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key  string `xml:"Key"`
+				ETag string `xml:"ETag"`
+				Size int64  `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object list: %w", err)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, Object{
+				Key:  content.Key,
+				ETag: strings.Trim(content.ETag, `"`),
+				Size: content.Size,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for the key, or for the bucket if the key is
+// empty. Responses other than 2xx are returned as errors, 404 as ErrNotFound.
+func (c *Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.Endpoint
+	if c.VirtualHosted {
+		u.Host = c.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket + "/" + key
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	// anonymous requests for public buckets
+	if c.Credentials.AccessKey != "" {
+		signV4(req, c.Credentials, c.Region, payloadHash, time.Now())
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+
+	// the error response names the reason, e.g. SignatureDoesNotMatch
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Redacted(), s3Err.Code, s3Err.Message)
+	}
+
+	return nil, fmt.Errorf("%s %s: unexpected status code %d", method, u.Redacted(), resp.StatusCode)
+}
@@ -0,0 +1,488 @@
+package s3
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/provider/archive"
+	"github.com/serversfordev/deploy/internal/signature"
+	"github.com/serversfordev/deploy/internal/utils"
+)
+
+const (
+	defaultRegion     = "us-east-1"
+	defaultLatest     = "latest"
+	defaultProfile    = "default"
+	defaultAccessEnv  = "AWS_ACCESS_KEY_ID"
+	defaultSecretEnv  = "AWS_SECRET_ACCESS_KEY"
+	sessionTokenEnv   = "AWS_SESSION_TOKEN"
+	defaultTimeout    = 10 * time.Minute
+	signatureSuffix   = ".minisig"
+	artifactsDir      = ".artifacts"
+	partialFileSuffix = ".partial"
+)
+
+// the version in the name of an artifact, e.g. app-1.4.2.tar.gz
+var versionPattern = regexp.MustCompile(`v?\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?`)
+
+// S3Provider deploys artifacts from an S3 compatible bucket. The artifact is
+// named by a pointer object or is the highest version under the prefix, its
+// version ID or ETag is the revision.
+type S3Provider struct {
+	config *config.Config
+	appDir string
+
+	client   *Client
+	object   *Object
+	artifact string
+	signedBy string
+}
+
+func New(config *config.Config, appDir string) *S3Provider {
+	return &S3Provider{
+		config: config,
+		appDir: appDir,
+	}
+}
+
+// Init resolves the artifact, downloads it and verifies its signature if
+// trusted keys are configured.
+func (p *S3Provider) Init() error {
+	if err := p.initClient(); err != nil {
+		return err
+	}
+
+	object, err := p.resolve()
+	if err != nil {
+		return err
+	}
+
+	if p.format(object.Key) == "" {
+		return fmt.Errorf("unknown archive format of %s, configure the format", object.Key)
+	}
+
+	artifact, err := p.download(object)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", object.Key, err)
+	}
+
+	p.signedBy = ""
+	if len(p.config.Source.Signature.PublicKeys) > 0 {
+		key, err := p.verifySignature(object, artifact)
+		if err != nil {
+			return err
+		}
+		p.signedBy = key
+	}
+
+	p.object = object
+	p.artifact = artifact
+
+	return nil
+}
+
+// RemoteRevision resolves the artifact without downloading it.
+func (p *S3Provider) RemoteRevision() (string, error) {
+	if err := p.initClient(); err != nil {
+		return "", err
+	}
+
+	object, err := p.resolve()
+	if err != nil {
+		return "", err
+	}
+
+	return revision(object), nil
+}
+
+func (p *S3Provider) GetRevision() (string, error) {
+	if p.object == nil {
+		return "", fmt.Errorf("artifact hasn't been resolved yet")
+	}
+	return revision(p.object), nil
+}
+
+func (p *S3Provider) ResolveRef(ref string) (string, error) {
+	return "", fmt.Errorf("failed to resolve ref %s: the s3 provider deploys the latest artifact", ref)
+}
+
+// Clone extracts the artifact into the release.
+func (p *S3Provider) Clone(targetDir string) error {
+	if err := archive.Extract(p.artifact, p.format(p.object.Key), targetDir, p.config.Source.S3.StripComponents); err != nil {
+		return fmt.Errorf("failed to extract artifact: %w", err)
+	}
+
+	return nil
+}
+
+// Metadata reports the deployed object.
+func (p *S3Provider) Metadata() map[string]string {
+	if p.object == nil {
+		return nil
+	}
+
+	metadata := map[string]string{
+		"bucket": p.config.Source.S3.Bucket,
+		"key":    p.object.Key,
+		"etag":   p.object.ETag,
+	}
+	if p.object.VersionID != "" {
+		metadata["version_id"] = p.object.VersionID
+	}
+	if p.signedBy != "" {
+		metadata["signed_by"] = p.signedBy
+	}
+
+	return metadata
+}
+
+func (p *S3Provider) initClient() error {
+	cfg := p.config.Source.S3
+	if cfg.Bucket == "" {
+		return fmt.Errorf("s3 bucket is not configured")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = defaultRegion
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+
+	timeout, err := utils.ParseDuration(cfg.Timeout, defaultTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+
+	creds, err := loadCredentials(p.appDir, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load s3 credentials: %w", err)
+	}
+
+	p.client = &Client{
+		Endpoint:      u,
+		Region:        region,
+		Bucket:        cfg.Bucket,
+		VirtualHosted: cfg.VirtualHosted,
+		Credentials:   creds,
+		HTTPClient:    &http.Client{Timeout: timeout},
+	}
+
+	return nil
+}
+
+// resolve returns the artifact the pointer object names, or the artifact
+// with the highest version under the prefix if there is no pointer object.
+func (p *S3Provider) resolve() (*Object, error) {
+	prefix := p.config.Source.S3.Prefix
+	latest := p.config.Source.S3.Latest
+	if latest == "" {
+		latest = defaultLatest
+	}
+
+	key, err := p.readPointer(prefix + latest)
+	if errors.Is(err, ErrNotFound) {
+		key, err = p.highestVersion(prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := p.client.Head(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve artifact: %w", err)
+	}
+
+	return object, nil
+}
+
+// readPointer reads the key of the artifact from the pointer object. A
+// relative key is relative to the prefix, a key starting with a slash to the
+// bucket.
+func (p *S3Provider) readPointer(key string) (string, error) {
+	resp, err := p.client.Get(key, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+
+	target := strings.TrimSpace(string(data))
+	if target == "" {
+		return "", fmt.Errorf("pointer object %s is empty", key)
+	}
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimPrefix(target, "/"), nil
+	}
+
+	return p.config.Source.S3.Prefix + target, nil
+}
+
+// highestVersion returns the key of the artifact with the highest version
+// under the prefix. Signatures and keys without a version are ignored.
+func (p *S3Provider) highestVersion(prefix string) (string, error) {
+	objects, err := p.client.List(prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list artifacts: %w", err)
+	}
+
+	var key string
+	var highest *semver.Version
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if strings.HasSuffix(name, signatureSuffix) || p.format(name) == "" {
+			continue
+		}
+
+		match := versionPattern.FindString(name)
+		if match == "" {
+			continue
+		}
+		version, err := semver.NewVersion(match)
+		if err != nil {
+			continue
+		}
+
+		if highest == nil || version.GreaterThan(highest) {
+			highest = version
+			key = object.Key
+		}
+	}
+
+	if key == "" {
+		return "", fmt.Errorf("no versioned artifact found under s3://%s/%s", p.config.Source.S3.Bucket, prefix)
+	}
+
+	return key, nil
+}
+
+// download stores the object in the artifacts directory, named after its
+// revision, resuming an interrupted download.
+func (p *S3Provider) download(object *Object) (string, error) {
+	dir := filepath.Join(p.appDir, artifactsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create artifacts directory: %w", err)
+	}
+
+	artifact := filepath.Join(dir, safeName(revision(object))+"-"+path.Base(object.Key))
+	if info, err := os.Stat(artifact); err == nil && info.Size() == object.Size {
+		return artifact, nil
+	}
+
+	partial := artifact + partialFileSuffix
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	resp, err := p.client.Get(object.Key, offset)
+	if err != nil && offset > 0 {
+		// the range can't be served, start over
+		offset = 0
+		resp, err = p.client.Get(object.Key, 0)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 || resp.StatusCode != http.StatusPartialContent {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+
+	out, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(partial)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != object.Size {
+		os.Remove(partial)
+		return "", fmt.Errorf("size mismatch: expected %d bytes, got %d", object.Size, info.Size())
+	}
+
+	if err := os.Rename(partial, artifact); err != nil {
+		return "", err
+	}
+
+	// only the current artifact is kept
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(artifact) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return artifact, nil
+}
+
+// verifySignature checks the signature object next to the artifact against
+// the trusted keys, before anything is extracted.
+func (p *S3Provider) verifySignature(object *Object, artifact string) (string, error) {
+	resp, err := p.client.Get(object.Key+signatureSuffix, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read signature: %w", err)
+	}
+	defer resp.Body.Close()
+
+	sig, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	verified, err := signature.VerifyWithKeys(artifact, sig, p.config.Source.Signature.PublicKeys)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify artifact %s: %w", object.Key, err)
+	}
+
+	return verified.Key.String(), nil
+}
+
+func (p *S3Provider) format(key string) string {
+	if p.config.Source.S3.Format != "" {
+		return p.config.Source.S3.Format
+	}
+	return archive.DetectFormat(key)
+}
+
+// revision returns the version ID of the object in a versioned bucket,
+// otherwise its ETag.
+func revision(object *Object) string {
+	if object.VersionID != "" && object.VersionID != "null" {
+		return object.VersionID
+	}
+	return object.ETag
+}
+
+// safeName makes a revision usable as part of a file name.
+func safeName(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// loadCredentials reads the access keys from the credentials file, if one is
+// configured, or from the environment. Without any keys the requests are
+// anonymous.
+func loadCredentials(appDir string, cfg config.S3Config) (Credentials, error) {
+	if cfg.CredentialsFile != "" {
+		file := cfg.CredentialsFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(appDir, file)
+		}
+		profile := cfg.Profile
+		if profile == "" {
+			profile = defaultProfile
+		}
+		return readCredentialsFile(file, profile)
+	}
+
+	accessEnv := cfg.AccessKeyEnv
+	if accessEnv == "" {
+		accessEnv = defaultAccessEnv
+	}
+	secretEnv := cfg.SecretKeyEnv
+	if secretEnv == "" {
+		secretEnv = defaultSecretEnv
+	}
+
+	creds := Credentials{
+		AccessKey:    os.Getenv(accessEnv),
+		SecretKey:    os.Getenv(secretEnv),
+		SessionToken: os.Getenv(sessionTokenEnv),
+	}
+	if (creds.AccessKey == "") != (creds.SecretKey == "") {
+		return Credentials{}, fmt.Errorf("both %s and %s have to be set", accessEnv, secretEnv)
+	}
+
+	return creds, nil
+}
+
+// readCredentialsFile reads a profile of a file in the format of
+// ~/.aws/credentials.
+func readCredentialsFile(file, profile string) (Credentials, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer f.Close()
+
+	var creds Credentials
+	found := false
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(strings.TrimPrefix(line[1:len(line)-1], "profile "))
+			found = found || section == profile
+			continue
+		}
+		if section != profile {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKey = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, err
+	}
+
+	if !found || creds.AccessKey == "" || creds.SecretKey == "" {
+		return Credentials{}, fmt.Errorf("no access keys for profile %s in %s", profile, file)
+	}
+
+	return creds, nil
+}
@@ -0,0 +1,77 @@
+package release
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const metadataFileName = "RELEASE.json"
+
+type Status string
+
+const (
+	// StatusPending is the status of a release that is being deployed.
+	StatusPending Status = "pending"
+	// StatusGood is the status of a release that passed verification and the
+	// bake period.
+	StatusGood Status = "good"
+)
+
+// Metadata describes a release. It is stored next to the REVISION file in the
+// release directory.
+type Metadata struct {
+	Revision   string     `json:"revision"`
+	Status     Status     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+
+	// the ref given with --ref, the release doesn't follow the branch
+	Ref    string `json:"ref,omitempty"`
+	Pinned bool   `json:"pinned,omitempty"`
+
+	// details reported by the provider, e.g. a rewritten history
+	Source map[string]string `json:"source,omitempty"`
+}
+
+func ReadMetadata(releaseDir string) (*Metadata, error) {
+	data, err := os.ReadFile(filepath.Join(releaseDir, metadataFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	var metadata Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata file: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+func WriteMetadata(releaseDir string, metadata *Metadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(releaseDir, metadataFileName), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateMetadata reads the metadata of the release, applies the changes made
+// by fn and writes it back.
+func UpdateMetadata(releaseDir string, fn func(metadata *Metadata)) error {
+	metadata, err := ReadMetadata(releaseDir)
+	if err != nil {
+		return err
+	}
+
+	fn(metadata)
+
+	return WriteMetadata(releaseDir, metadata)
+}
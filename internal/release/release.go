@@ -18,7 +18,7 @@ func UpdateCurrent(appDir string, releaseDir string) error {
 	// Set previous symlink if current exists
 	if currentSymlinkTarget, err := os.Readlink(currentSymlink); err == nil {
 		err = os.Remove(previousSymlink)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("failed to remove previous symlink: %w", err)
 		}
 
@@ -56,9 +56,8 @@ func Rollback(appDir string) error {
 }
 
 func NewRelease(appDir string, revisionID string) (string, error) {
-	timestamp := time.Now().Format("20060102_150405")
-	releaseDir := filepath.Join(appDir, "releases", timestamp)
-	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+	releaseDir, err := createReleaseDir(filepath.Join(appDir, "releases"))
+	if err != nil {
 		return "", fmt.Errorf("failed to create release directory: %w", err)
 	}
 
@@ -67,9 +66,54 @@ func NewRelease(appDir string, revisionID string) (string, error) {
 		return "", fmt.Errorf("failed to write revision file: %w", err)
 	}
 
+	metadata := &Metadata{
+		Revision:  revisionID,
+		Status:    StatusPending,
+		CreatedAt: time.Now(),
+	}
+	if err := WriteMetadata(releaseDir, metadata); err != nil {
+		return "", err
+	}
+
 	return releaseDir, nil
 }
 
+// createReleaseDir creates a release directory named after the current time.
+// A release created within the same second gets a numbered suffix instead of
+// reusing the directory of the other release.
+func createReleaseDir(releasesDir string) (string, error) {
+	if err := os.MkdirAll(releasesDir, 0755); err != nil {
+		return "", err
+	}
+
+	timestamp := time.Now().Format("20060102_150405")
+	name := timestamp
+	for i := 1; ; i++ {
+		releaseDir := filepath.Join(releasesDir, name)
+		err := os.Mkdir(releaseDir, 0755)
+		if err == nil {
+			return releaseDir, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		name = fmt.Sprintf("%s_%d", timestamp, i)
+	}
+}
+
+// Current returns the directory of the current release.
+func Current(appDir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(appDir, "current"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNoCurrentRelease
+		}
+		return "", fmt.Errorf("failed to read current symlink: %w", err)
+	}
+
+	return target, nil
+}
+
 func CurrentRevision(appDir string) (string, error) {
 	currentSymlink := filepath.Join(appDir, "current")
 	if _, err := os.Readlink(currentSymlink); err != nil {
@@ -0,0 +1,230 @@
+package reload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/utils"
+)
+
+const (
+	TypeSignal  = "signal"
+	TypeCommand = "command"
+	TypeHTTP    = "http"
+	TypeTouch   = "touch"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+
+	commandWaitDelay = time.Second
+)
+
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// Options configures the environment reload actions are run in.
+type Options struct {
+	// AppDir is the base for relative pidfile and touch paths.
+	AppDir string
+	// ReleaseDir is the working directory of command actions.
+	ReleaseDir string
+	// Logf writes a message to the deployment log.
+	Logf func(format string, v ...interface{})
+}
+
+// Run executes the reload actions in order and logs their results. It stops
+// at the first action that fails.
+func Run(actions []config.ReloadConfig, opts Options) error {
+	for _, action := range actions {
+		start := time.Now()
+
+		if err := run(action, opts); err != nil {
+			opts.Logf("reload %s: failed: %s", Name(action), err)
+			return fmt.Errorf("reload %s failed: %w", Name(action), err)
+		}
+
+		opts.Logf("reload %s: done in %s", Name(action), time.Since(start).Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+// Name returns the configured name of the action, or a description of its
+// target if it has none.
+func Name(action config.ReloadConfig) string {
+	if action.Name != "" {
+		return action.Name
+	}
+
+	switch action.Type {
+	case TypeSignal:
+		return "signal " + action.PIDFile
+	case TypeCommand:
+		return "command " + action.Command
+	case TypeHTTP:
+		return "http " + action.URL
+	case TypeTouch:
+		return "touch " + action.Path
+	default:
+		return action.Type
+	}
+}
+
+func run(action config.ReloadConfig, opts Options) error {
+	timeout, err := utils.ParseDuration(action.Timeout, defaultTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch action.Type {
+	case TypeSignal:
+		return sendSignal(action, opts)
+	case TypeCommand:
+		if action.Command == "" {
+			return fmt.Errorf("command action requires a command")
+		}
+
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", action.Command)
+		cmd.Dir = opts.ReleaseDir
+
+		// on timeout the whole group is killed, and the output isn't
+		// waited for when a background child keeps it open
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		cmd.WaitDelay = commandWaitDelay
+
+		output, err := cmd.CombinedOutput()
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// the command succeeded, a background child kept the output open
+			err = nil
+		}
+		output = bytes.TrimSpace(output)
+		if err != nil && len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	case TypeHTTP:
+		return callEndpoint(ctx, action)
+	case TypeTouch:
+		if action.Path == "" {
+			return fmt.Errorf("touch action requires a path")
+		}
+		return touch(resolvePath(opts.AppDir, action.Path))
+	default:
+		return fmt.Errorf("unknown reload type: %s", action.Type)
+	}
+}
+
+func sendSignal(action config.ReloadConfig, opts Options) error {
+	if action.PIDFile == "" {
+		return fmt.Errorf("signal action requires a pidfile")
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(action.Signal), "SIG")
+	if name == "" {
+		name = "HUP"
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return fmt.Errorf("unknown signal: %s", action.Signal)
+	}
+
+	data, err := os.ReadFile(resolvePath(opts.AppDir, action.PIDFile))
+	if err != nil {
+		return fmt.Errorf("failed to read pidfile: %w", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid pid in pidfile: %w", err)
+	}
+	// 0 and negative pids signal process groups, e.g. the deployer's own
+	if pid <= 0 {
+		return fmt.Errorf("invalid pid in pidfile: %d", pid)
+	}
+
+	if err := syscall.Kill(pid, 0); err != nil {
+		return fmt.Errorf("process %d of the pidfile isn't running: %w", pid, err)
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("failed to send %s to %d: %w", name, pid, err)
+	}
+
+	return nil
+}
+
+func callEndpoint(ctx context.Context, action config.ReloadConfig) error {
+	if action.URL == "" {
+		return fmt.Errorf("http action requires an url")
+	}
+
+	method := action.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, action.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func touch(path string) error {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func resolvePath(appDir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(appDir, path)
+}
@@ -0,0 +1,371 @@
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign algorithms, see https://jedisct1.github.io/minisign/
+var (
+	algEd        = []byte("Ed") // legacy, signs the data itself
+	algPrehashed = []byte("ED") // signs the BLAKE2b-512 hash of the data
+	kdfNone      = []byte{0, 0}
+	cksumBlake2b = []byte("B2")
+)
+
+const (
+	keyIDSize = 8
+
+	untrustedPrefix = "untrusted comment: "
+	trustedPrefix   = "trusted comment: "
+)
+
+// PublicKey is a trusted key, either a minisign public key or a raw ed25519
+// public key, which has no key ID.
+type PublicKey struct {
+	ID  []byte
+	Key ed25519.PublicKey
+}
+
+// ParsePublicKey parses a minisign public key, with or without the untrusted
+// comment line, or a base64 encoded raw ed25519 public key.
+func ParsePublicKey(value string) (*PublicKey, error) {
+	data, err := decodeBase64(lastLine(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	switch {
+	case len(data) == ed25519.PublicKeySize:
+		return &PublicKey{Key: ed25519.PublicKey(data)}, nil
+	case len(data) == 2+keyIDSize+ed25519.PublicKeySize && bytes.Equal(data[:2], algEd):
+		return &PublicKey{ID: data[2 : 2+keyIDSize], Key: ed25519.PublicKey(data[2+keyIDSize:])}, nil
+	default:
+		return nil, fmt.Errorf("invalid public key: neither a minisign nor an ed25519 public key")
+	}
+}
+
+// String returns the key ID as shown by minisign, or the key itself for a
+// raw key.
+func (k *PublicKey) String() string {
+	if k.ID == nil {
+		return base64.StdEncoding.EncodeToString(k.Key)
+	}
+
+	// minisign shows the little-endian key ID as a number
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(k.ID))
+}
+
+// Verified is a valid signature.
+type Verified struct {
+	// Key is the trusted key that made the signature
+	Key *PublicKey
+	// TrustedComment is the signed comment of a minisign signature, raw
+	// signatures have none
+	TrustedComment string
+}
+
+// Field returns the value of a field of the trusted comment, which holds
+// tab-separated name:value pairs, e.g. "timestamp:1700000000\tfile:app.tar.gz".
+func (v *Verified) Field(name string) (string, bool) {
+	for _, field := range strings.Split(v.TrustedComment, "\t") {
+		if key, value, ok := strings.Cut(field, ":"); ok && key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Verify checks the detached signature of the file against the trusted keys.
+// The signature is either a minisign signature or a raw ed25519 signature of
+// the contents, base64 encoded or binary.
+func Verify(file string, sig []byte, keys []*PublicKey) (*Verified, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no trusted public keys configured")
+	}
+
+	if raw := rawSignature(sig); raw != nil {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if ed25519.Verify(key.Key, data, raw) {
+				return &Verified{Key: key}, nil
+			}
+		}
+		return nil, fmt.Errorf("signature verification failed: not signed by any trusted key")
+	}
+
+	s, err := parseSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+
+	key := findKey(keys, s.keyID)
+	if key == nil {
+		return nil, fmt.Errorf("signature verification failed: signed by untrusted key %016X", binary.LittleEndian.Uint64(s.keyID))
+	}
+
+	var message []byte
+	if bytes.Equal(s.alg, algPrehashed) {
+		message, err = hashFile(file)
+	} else {
+		message, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !ed25519.Verify(key.Key, message, s.signature) {
+		return nil, fmt.Errorf("signature verification failed: invalid signature by key %s", key)
+	}
+	if !ed25519.Verify(key.Key, append(append([]byte{}, s.signature...), s.trustedComment...), s.globalSignature) {
+		return nil, fmt.Errorf("signature verification failed: invalid trusted comment signature by key %s", key)
+	}
+
+	return &Verified{Key: key, TrustedComment: s.trustedComment}, nil
+}
+
+// Sign returns a minisign signature of the file, made with a prehashed
+// signature algorithm, so the file doesn't have to fit into memory.
+func Sign(file string, secretKey []byte, trustedComment string) ([]byte, error) {
+	keyID, key, err := parseSecretKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if trustedComment == "" {
+		trustedComment = TrustedComment(file, "")
+	}
+	if strings.ContainsAny(trustedComment, "\r\n") {
+		return nil, fmt.Errorf("trusted comment must be a single line")
+	}
+
+	signature := ed25519.Sign(key, hash)
+	globalSignature := ed25519.Sign(key, append(append([]byte{}, signature...), trustedComment...))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%ssignature from deploy secret key\n", untrustedPrefix)
+	fmt.Fprintln(&buf, base64.StdEncoding.EncodeToString(concat(algPrehashed, keyID, signature)))
+	fmt.Fprintf(&buf, "%s%s\n", trustedPrefix, trustedComment)
+	fmt.Fprintln(&buf, base64.StdEncoding.EncodeToString(globalSignature))
+
+	return buf.Bytes(), nil
+}
+
+// TrustedComment returns the default trusted comment of a signature of the
+// file, the fields minisign writes and the version of the file, if given.
+func TrustedComment(file, version string) string {
+	comment := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), filepath.Base(file))
+	if version != "" {
+		comment += "\tversion:" + version
+	}
+	return comment
+}
+
+// GenerateKey returns a new unencrypted minisign key pair, in the format of
+// minisign key files.
+func GenerateKey() (publicKey, secretKey []byte, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyID := make([]byte, keyIDSize)
+	salt := make([]byte, 32)
+	if _, err := rand.Read(keyID); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+
+	id := fmt.Sprintf("%016X", binary.LittleEndian.Uint64(keyID))
+	checksum := blake2b.Sum256(concat(algEd, keyID, priv))
+	limits := make([]byte, 16)
+
+	secret := concat(algEd, kdfNone, cksumBlake2b, salt, limits, keyID, priv, checksum[:])
+	secretKey = []byte(fmt.Sprintf("%sminisign secret key %s\n%s\n", untrustedPrefix, id, base64.StdEncoding.EncodeToString(secret)))
+
+	public := concat(algEd, keyID, pub)
+	publicKey = []byte(fmt.Sprintf("%sminisign public key %s\n%s\n", untrustedPrefix, id, base64.StdEncoding.EncodeToString(public)))
+
+	return publicKey, secretKey, nil
+}
+
+// parseSecretKey parses an unencrypted minisign secret key or a base64
+// encoded raw ed25519 private key or seed. Raw keys sign without a key ID.
+func parseSecretKey(value []byte) ([]byte, ed25519.PrivateKey, error) {
+	data, err := decodeBase64(lastLine(string(value)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid secret key: %w", err)
+	}
+
+	switch len(data) {
+	case ed25519.SeedSize:
+		return make([]byte, keyIDSize), ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		return make([]byte, keyIDSize), ed25519.PrivateKey(data), nil
+	case 2 + 2 + 2 + 32 + 16 + keyIDSize + ed25519.PrivateKeySize + 32:
+	default:
+		return nil, nil, fmt.Errorf("invalid secret key: neither a minisign nor an ed25519 secret key")
+	}
+
+	if !bytes.Equal(data[:2], algEd) || !bytes.Equal(data[4:6], cksumBlake2b) {
+		return nil, nil, fmt.Errorf("invalid secret key: unsupported algorithm")
+	}
+	if !bytes.Equal(data[2:4], kdfNone) {
+		return nil, nil, fmt.Errorf("encrypted secret keys aren't supported, create the key without a password (minisign -G -W)")
+	}
+
+	keynum := data[2+2+2+32+16:]
+	keyID := keynum[:keyIDSize]
+	key := keynum[keyIDSize : keyIDSize+ed25519.PrivateKeySize]
+	checksum := blake2b.Sum256(concat(algEd, keyID, key))
+	if !bytes.Equal(checksum[:], keynum[keyIDSize+ed25519.PrivateKeySize:]) {
+		return nil, nil, fmt.Errorf("invalid secret key: checksum mismatch")
+	}
+
+	return keyID, ed25519.PrivateKey(key), nil
+}
+
+// minisignSignature is a parsed minisign signature file.
+type minisignSignature struct {
+	alg             []byte
+	keyID           []byte
+	signature       []byte
+	trustedComment  string
+	globalSignature []byte
+}
+
+func parseSignature(data []byte) (*minisignSignature, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], untrustedPrefix) || !strings.HasPrefix(lines[2], trustedPrefix) {
+		return nil, fmt.Errorf("invalid signature: not a minisign signature")
+	}
+
+	sig, err := decodeBase64(lines[1])
+	if err != nil || len(sig) != 2+keyIDSize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature: malformed signature line")
+	}
+	if !bytes.Equal(sig[:2], algEd) && !bytes.Equal(sig[:2], algPrehashed) {
+		return nil, fmt.Errorf("invalid signature: unsupported algorithm %q", sig[:2])
+	}
+
+	global, err := decodeBase64(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature: malformed trusted comment signature")
+	}
+
+	return &minisignSignature{
+		alg:             sig[:2],
+		keyID:           sig[2 : 2+keyIDSize],
+		signature:       sig[2+keyIDSize:],
+		trustedComment:  strings.TrimPrefix(lines[2], trustedPrefix),
+		globalSignature: global,
+	}, nil
+}
+
+// rawSignature returns a raw ed25519 signature, binary or base64 encoded, or
+// nil if the data isn't one.
+func rawSignature(data []byte) []byte {
+	if len(data) == ed25519.SignatureSize {
+		return data
+	}
+	if decoded, err := decodeBase64(string(data)); err == nil && len(decoded) == ed25519.SignatureSize {
+		return decoded
+	}
+	return nil
+}
+
+// findKey returns the minisign key with the ID. Raw keys are tried too, as
+// a raw secret key signs with an empty ID.
+func findKey(keys []*PublicKey, id []byte) *PublicKey {
+	for _, key := range keys {
+		if key.ID != nil && bytes.Equal(key.ID, id) {
+			return key
+		}
+	}
+	if bytes.Equal(id, make([]byte, keyIDSize)) {
+		for _, key := range keys {
+			if key.ID == nil {
+				return key
+			}
+		}
+	}
+	return nil
+}
+
+// hashFile returns the BLAKE2b-512 hash of the file.
+func hashFile(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func decodeBase64(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+}
+
+// lastLine returns the last non-empty line, the key of a minisign key file.
+func lastLine(value string) string {
+	lines := strings.Split(strings.TrimSpace(value), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// VerifyWithKeys parses the trusted keys, as listed in the config, and checks
+// the signature of the file against them. See Verify.
+func VerifyWithKeys(file string, sig []byte, publicKeys []string) (*Verified, error) {
+	keys := make([]*PublicKey, 0, len(publicKeys))
+	for _, value := range publicKeys {
+		key, err := ParsePublicKey(value)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return Verify(file, sig, keys)
+}
@@ -0,0 +1,48 @@
+package supervisor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const procfileName = "Procfile"
+
+// ReadProcfile parses the Procfile of a release. Each line defines a process
+// as "<name>: <command>", blank lines and lines starting with # are ignored.
+func ReadProcfile(releaseDir string) (map[string]string, error) {
+	file, err := os.Open(filepath.Join(releaseDir, procfileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	processes := make(map[string]string)
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, command, found := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		command = strings.TrimSpace(command)
+		if !found || name == "" || command == "" {
+			return nil, fmt.Errorf("invalid Procfile entry on line %d: %s", lineNumber, line)
+		}
+
+		processes[name] = command
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Procfile: %w", err)
+	}
+
+	return processes, nil
+}
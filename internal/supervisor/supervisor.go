@@ -0,0 +1,279 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/serversfordev/deploy/internal/config"
+	"github.com/serversfordev/deploy/internal/logger"
+	"github.com/serversfordev/deploy/internal/release"
+	"github.com/serversfordev/deploy/internal/utils"
+)
+
+const (
+	pollInterval = time.Second
+
+	// a process that ran at least this long before exiting restarts with
+	// the initial backoff again
+	stableRuntime = 30 * time.Second
+)
+
+// Supervisor runs the processes of the current release and restarts them
+// whenever the current release changes, be it a deployment or a rollback.
+type Supervisor struct {
+	config *config.Config
+	appDir string
+	logger *logger.Logger
+
+	gracePeriod time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	releaseDir string
+	processes  map[string]*process
+}
+
+func New(cfg *config.Config, appDir string, logger *logger.Logger) (*Supervisor, error) {
+	gracePeriod, err := utils.ParseDuration(cfg.Supervise.GracePeriod, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grace period: %w", err)
+	}
+	minBackoff, err := utils.ParseDuration(cfg.Supervise.Backoff, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backoff: %w", err)
+	}
+	maxBackoff, err := utils.ParseDuration(cfg.Supervise.MaxBackoff, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max backoff: %w", err)
+	}
+
+	return &Supervisor{
+		config:      cfg,
+		appDir:      appDir,
+		logger:      logger,
+		gracePeriod: gracePeriod,
+		minBackoff:  minBackoff,
+		maxBackoff:  max(minBackoff, maxBackoff),
+		processes:   make(map[string]*process),
+	}, nil
+}
+
+// Run supervises the processes until the context is cancelled, then stops
+// all of them.
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.logger.Printf("supervising processes of %s", s.appDir)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		releaseDir, err := release.Current(s.appDir)
+		switch {
+		case err == release.ErrNoCurrentRelease:
+			// nothing deployed yet
+		case err != nil:
+			s.logger.Printf("failed to resolve current release: %s", err)
+		case releaseDir != s.releaseDir:
+			s.switchRelease(releaseDir)
+		}
+
+		select {
+		case <-ctx.Done():
+			s.logger.Printf("stopping processes")
+			for _, name := range s.names() {
+				s.processes[name].terminate()
+				delete(s.processes, name)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// switchRelease does a rolling restart of the processes onto the given
+// release: one by one, each process is stopped and started again from the
+// new release directory.
+func (s *Supervisor) switchRelease(releaseDir string) {
+	previousReleaseDir := s.releaseDir
+	// don't retry the same release on every poll
+	s.releaseDir = releaseDir
+
+	definitions, err := s.definitions(releaseDir)
+	if err != nil {
+		s.logger.Printf("failed to load process definitions of %s: %s", releaseDir, err)
+		return
+	}
+
+	if previousReleaseDir == "" {
+		s.logger.Printf("starting processes of %s", releaseDir)
+	} else {
+		s.logger.Printf("current release changed to %s, restarting processes", releaseDir)
+	}
+
+	for _, name := range s.names() {
+		if _, ok := definitions[name]; !ok {
+			s.logger.Printf("stopping removed process %s", name)
+			s.processes[name].terminate()
+			delete(s.processes, name)
+		}
+	}
+
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if p, ok := s.processes[name]; ok {
+			s.logger.Printf("restarting process %s", name)
+			p.terminate()
+		} else {
+			s.logger.Printf("starting process %s", name)
+		}
+
+		p := &process{
+			name:        name,
+			command:     definitions[name],
+			dir:         releaseDir,
+			logFile:     filepath.Join(s.appDir, "logs", name+".log"),
+			logf:        s.logger.Printf,
+			gracePeriod: s.gracePeriod,
+			minBackoff:  s.minBackoff,
+			maxBackoff:  s.maxBackoff,
+			stop:        make(chan struct{}),
+			done:        make(chan struct{}),
+		}
+		go p.run()
+
+		s.processes[name] = p
+	}
+}
+
+// definitions returns the processes to run: the [processes] table of the
+// config if it isn't empty, the Procfile of the release otherwise.
+func (s *Supervisor) definitions(releaseDir string) (map[string]string, error) {
+	if len(s.config.Processes) > 0 {
+		return s.config.Processes, nil
+	}
+
+	processes, err := ReadProcfile(releaseDir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no processes configured and no Procfile found")
+	}
+
+	return processes, err
+}
+
+func (s *Supervisor) names() []string {
+	names := make([]string, 0, len(s.processes))
+	for name := range s.processes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+type process struct {
+	name    string
+	command string
+	dir     string
+	logFile string
+	logf    func(format string, v ...interface{})
+
+	gracePeriod time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// run keeps the process running, restarting it with an exponential backoff
+// whenever it exits, until it is terminated.
+func (p *process) run() {
+	defer close(p.done)
+
+	backoff := p.minBackoff
+	for {
+		cmd, exited, err := p.start()
+		if err != nil {
+			p.logf("failed to start process %s: %s", p.name, err)
+		} else {
+			started := time.Now()
+
+			select {
+			case err := <-exited:
+				p.logf("process %s exited: %v", p.name, err)
+				if time.Since(started) >= stableRuntime {
+					backoff = p.minBackoff
+				}
+			case <-p.stop:
+				p.kill(cmd, exited)
+				return
+			}
+		}
+
+		p.logf("restarting process %s in %s", p.name, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-p.stop:
+			return
+		}
+		backoff = min(backoff*2, p.maxBackoff)
+	}
+}
+
+func (p *process) start() (*exec.Cmd, chan error, error) {
+	logFile, err := os.OpenFile(p.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", p.command)
+	cmd.Dir = p.dir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// run the process in its own group, so signals reach its children too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return nil, nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+		logFile.Close()
+	}()
+
+	return cmd, exited, nil
+}
+
+// kill sends SIGTERM to the process group and SIGKILL if it didn't exit
+// within the grace period.
+func (p *process) kill(cmd *exec.Cmd, exited chan error) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+
+	select {
+	case <-exited:
+	case <-time.After(p.gracePeriod):
+		p.logf("process %s didn't stop within %s, killing it", p.name, p.gracePeriod)
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+	}
+}
+
+// terminate stops the process and waits until it exited.
+func (p *process) terminate() {
+	close(p.stop)
+	<-p.done
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/BurntSushi/toml"
@@ -59,3 +60,12 @@ func InitializeAppStructure(appName string) (string, error) {
 
 	return baseDir, nil
 }
+
+// ParseDuration parses a duration string like "30s" or "10m". An empty value
+// returns the fallback.
+func ParseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}